@@ -0,0 +1,453 @@
+// Package cache is a shared HTTP cache for proxied responses. It follows
+// Cache-Control, Expires and Vary, serves stale entries while revalidating
+// or when the upstream fails, and sends only one request per key upstream.
+package cache
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"slashing/config"
+)
+
+// Cache holds the cached responses of all routes.
+type Cache struct {
+	store Store
+
+	mu       sync.Mutex
+	flights  map[string]*flight
+	bans     []ban
+	lifetime time.Duration //longest lifetime of an entry, bans older than it are moot
+
+	metaMu sync.Mutex //read-modify-write of the meta entries
+}
+
+// flight is a request on its way upstream, that other requests for the same
+// key wait for.
+type flight struct {
+	done chan struct{}
+}
+
+type ban struct {
+	host    string
+	pattern *regexp.Regexp
+	at      time.Time
+}
+
+func New(store Store) *Cache {
+	return &Cache{store: store, flights: map[string]*flight{}}
+}
+
+// Handler caches the responses of next according to rules.
+func (c *Cache) Handler(next http.Handler, rules *config.Cache) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !cacheableRequest(r) {
+			w.Header().Set("X-Cache", "BYPASS")
+			next.ServeHTTP(w, r)
+			return
+		}
+		key := Key(r)
+		now := time.Now()
+		entry := c.lookup(key, r)
+		switch {
+		case entry != nil && entry.fresh(now):
+			serveEntry(w, r, entry, "HIT", now)
+		case entry != nil && entry.staleWithin(now, entry.StaleWhileRevalidate):
+			serveEntry(w, r, entry, "STALE", now)
+			c.revalidate(next, r, key, rules)
+		default:
+			if entry != nil && !entry.staleWithin(now, entry.StaleIfError) {
+				entry = nil
+			}
+			c.fetch(w, r, next, key, rules, entry)
+		}
+	})
+}
+
+// Key is the cache key of a request: its host and request URI.
+func Key(r *http.Request) string {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(host) + r.URL.RequestURI()
+}
+
+// metaKey is the key of the meta entry of a URL: the Vary header of its
+// responses on the first line, then the keys of the variants stored.
+func metaKey(key string) string {
+	return "meta:" + key
+}
+
+// maxVariants bounds the variants a meta entry lists, the oldest go.
+const maxVariants = 100
+
+func readMeta(meta []byte) (string, []string) {
+	lines := strings.Split(string(meta), "\n")
+	return lines[0], lines[1:]
+}
+
+// variantKey is the key of the response to r among those varying by names.
+func variantKey(key string, names []string, r *http.Request) string {
+	variant := "obj:" + key
+	for _, name := range names {
+		variant += "\x00" + strings.Join(r.Header.Values(name), ",")
+	}
+	return variant
+}
+
+// lookup returns the stored response for r, fresh or not.
+func (c *Cache) lookup(key string, r *http.Request) *Entry {
+	meta, ok := c.store.Get(metaKey(key))
+	if !ok {
+		return nil
+	}
+	vary, _ := readMeta(meta)
+	variant := variantKey(key, varyNames(vary), r)
+	data, ok := c.store.Get(variant)
+	if !ok {
+		return nil
+	}
+	entry, err := decodeEntry(data)
+	if err != nil || entry.Key != key || c.banned(entry) {
+		c.store.Delete(variant)
+		return nil
+	}
+	if credentialed(r) && !entry.Public {
+		return nil
+	}
+	return entry
+}
+
+func (c *Cache) save(r *http.Request, entry *Entry) {
+	vary := strings.Join(entry.Header.Values("Vary"), ",")
+	data, err := entry.encode()
+	if err != nil {
+		log.Println("Cache: cannot encode", entry.Key, err)
+		return
+	}
+	c.mu.Lock()
+	if lifetime := entry.lifetime(); lifetime > c.lifetime {
+		c.lifetime = lifetime
+	}
+	metaLifetime := c.lifetime
+	c.mu.Unlock()
+
+	variant := variantKey(entry.Key, varyNames(vary), r)
+	variants := []string{variant}
+	c.metaMu.Lock()
+	defer c.metaMu.Unlock()
+	if meta, ok := c.store.Get(metaKey(entry.Key)); ok {
+		oldVary, oldVariants := readMeta(meta)
+		for _, old := range oldVariants {
+			switch {
+			case old == variant:
+			case oldVary == vary && len(variants) < maxVariants:
+				variants = append(variants, old)
+			default:
+				//it could not be found anymore
+				c.store.Delete(old)
+			}
+		}
+	}
+	//the meta entry outlives its variants
+	c.store.Set(metaKey(entry.Key), []byte(vary+"\n"+strings.Join(variants, "\n")), metaLifetime)
+	c.store.Set(variant, data, entry.lifetime())
+}
+
+// drop deletes the meta entry of a URL and its variants.
+func (c *Cache) drop(key string) {
+	c.metaMu.Lock()
+	defer c.metaMu.Unlock()
+	if meta, ok := c.store.Get(metaKey(key)); ok {
+		_, variants := readMeta(meta)
+		for _, variant := range variants {
+			c.store.Delete(variant)
+		}
+	}
+	c.store.Delete(metaKey(key))
+}
+
+func varyNames(vary string) []string {
+	names := []string{}
+	for _, name := range strings.Split(vary, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, http.CanonicalHeaderKey(name))
+		}
+	}
+	return names
+}
+
+// fetch sends r upstream and caches the response. Concurrent requests for
+// the same key wait for the first one and are then served from the cache.
+// When stale is set, it replaces an upstream error (stale-if-error).
+func (c *Cache) fetch(w http.ResponseWriter, r *http.Request, next http.Handler, key string, rules *config.Cache, stale *Entry) {
+	c.mu.Lock()
+	if f, ok := c.flights[key]; ok {
+		c.mu.Unlock()
+		select {
+		case <-f.done:
+		case <-r.Context().Done():
+			return
+		}
+		if entry := c.lookup(key, r); entry != nil && entry.fresh(time.Now()) {
+			serveEntry(w, r, entry, "HIT", time.Now())
+			return
+		}
+		//the response was not cacheable or varies, go on our own
+		w.Header().Set("X-Cache", "MISS")
+		next.ServeHTTP(w, r)
+		return
+	}
+	f := &flight{done: make(chan struct{})}
+	c.flights[key] = f
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.flights, key)
+		c.mu.Unlock()
+		close(f.done)
+	}()
+
+	fw := &fetchWriter{client: w, header: http.Header{}, max: rules.MaxObject, fallback: stale != nil}
+	next.ServeHTTP(fw, r)
+	if fw.discarded {
+		log.Printf("Cache: serving stale %s after upstream status %d", key, fw.status)
+		serveEntry(w, r, stale, "STALE", time.Now())
+		return
+	}
+	fw.finish(c, r, key, rules)
+}
+
+// revalidate refreshes an entry in the background, unless that is already
+// being done.
+func (c *Cache) revalidate(next http.Handler, r *http.Request, key string, rules *config.Cache) {
+	c.mu.Lock()
+	if _, ok := c.flights[key]; ok {
+		c.mu.Unlock()
+		return
+	}
+	f := &flight{done: make(chan struct{})}
+	c.flights[key] = f
+	c.mu.Unlock()
+
+	r = r.Clone(detached{r.Context()})
+	go func() {
+		defer func() {
+			if err := recover(); err != nil && err != http.ErrAbortHandler {
+				log.Println("Cache: revalidation of", key, "panicked:", err)
+			}
+			c.mu.Lock()
+			delete(c.flights, key)
+			c.mu.Unlock()
+			close(f.done)
+		}()
+		fw := &fetchWriter{header: http.Header{}, max: rules.MaxObject}
+		next.ServeHTTP(fw, r)
+		fw.finish(c, r, key, rules)
+	}()
+}
+
+// detached keeps the values of a request context but not its cancellation,
+// so a background revalidation outlives the request that triggered it.
+type detached struct {
+	context.Context
+}
+
+type backgroundKey struct{}
+
+func (detached) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detached) Done() <-chan struct{}       { return nil }
+func (detached) Err() error                  { return nil }
+
+func (d detached) Value(key interface{}) interface{} {
+	if key == (backgroundKey{}) {
+		return true
+	}
+	return d.Context.Value(key)
+}
+
+// Background reports whether r is a revalidation the cache sends on its
+// own. The client that triggered it may have got its response already.
+func Background(r *http.Request) bool {
+	background, _ := r.Context().Value(backgroundKey{}).(bool)
+	return background
+}
+
+// serveEntry writes a cached response.
+func serveEntry(w http.ResponseWriter, r *http.Request, entry *Entry, state string, now time.Time) {
+	header := w.Header()
+	for name, values := range entry.Header {
+		header[name] = append([]string(nil), values...)
+	}
+	header.Set("Age", strconv.Itoa(int(entry.age(now).Seconds())))
+	header.Set("X-Cache", state)
+	if etag := entry.Header.Get("ETag"); etag != "" && etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.WriteHeader(entry.Status)
+	if r.Method != http.MethodHead {
+		w.Write(entry.Body)
+	}
+}
+
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// fetchWriter passes an upstream response on to the client while keeping a
+// copy of it for the cache.
+type fetchWriter struct {
+	client   http.ResponseWriter //nil for background revalidations
+	header   http.Header
+	status   int
+	body     bytes.Buffer
+	max      int64
+	keep     bool //still collecting the body for the cache
+	fallback bool //an error may be replaced by a stale entry
+
+	wroteHeader bool
+	discarded   bool //the response was an error replaced by a stale entry
+}
+
+func (fw *fetchWriter) Header() http.Header {
+	return fw.header
+}
+
+func (fw *fetchWriter) WriteHeader(status int) {
+	if fw.wroteHeader {
+		return
+	}
+	fw.wroteHeader, fw.status = true, status
+	if fw.fallback && status >= 500 {
+		fw.discarded = true
+		return
+	}
+	fw.keep = cacheableStatus[status]
+	if fw.client != nil {
+		header := fw.client.Header()
+		for name, values := range fw.header {
+			header[name] = values
+		}
+		header.Set("X-Cache", "MISS")
+		fw.client.WriteHeader(status)
+	}
+}
+
+func (fw *fetchWriter) Write(b []byte) (int, error) {
+	if !fw.wroteHeader {
+		fw.WriteHeader(http.StatusOK)
+	}
+	if fw.discarded {
+		return len(b), nil
+	}
+	if fw.keep {
+		if int64(fw.body.Len()+len(b)) > fw.max {
+			fw.keep = false
+			fw.body = bytes.Buffer{}
+		} else {
+			fw.body.Write(b)
+		}
+	}
+	if fw.client == nil {
+		return len(b), nil
+	}
+	return fw.client.Write(b)
+}
+
+func (fw *fetchWriter) Flush() {
+	if flusher, ok := fw.client.(http.Flusher); ok && !fw.discarded {
+		flusher.Flush()
+	}
+}
+
+// finish stores the response if it may be cached.
+func (fw *fetchWriter) finish(c *Cache, r *http.Request, key string, rules *config.Cache) {
+	if !fw.keep || r.Method != http.MethodGet {
+		return
+	}
+	header := fw.header.Clone()
+	header.Del("X-Cache")
+	entry := newEntry(key, fw.status, header, fw.body.Bytes(), rules, time.Now())
+	if entry != nil && (entry.Public || !credentialed(r)) {
+		c.save(r, entry)
+	}
+}
+
+// Purge drops the cached responses of a URL, given as https://host/path?query
+// or host/path?query.
+func (c *Cache) Purge(rawURL string) error {
+	if !strings.Contains(rawURL, "://") {
+		rawURL = "https://" + rawURL
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	c.drop(strings.ToLower(u.Hostname()) + u.RequestURI())
+	return nil
+}
+
+// Ban makes every response of host cached until now whose request URI
+// matches pattern a miss, and deletes them. An empty host bans on all hosts.
+func (c *Cache) Ban(host string, pattern string) error {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	b := ban{host: strings.ToLower(host), pattern: re, at: now}
+	c.mu.Lock()
+	bans := []ban{}
+	for _, old := range c.bans {
+		if now.Sub(old.at) <= c.lifetime {
+			bans = append(bans, old)
+		}
+	}
+	c.bans = append(bans, b)
+	c.mu.Unlock()
+
+	//the ban itself still catches the responses saved meanwhile
+	for _, key := range c.store.Keys() {
+		if strings.HasPrefix(key, "meta:") && b.matches(strings.TrimPrefix(key, "meta:")) {
+			c.drop(strings.TrimPrefix(key, "meta:"))
+		}
+	}
+	return nil
+}
+
+// matches reports whether the ban covers the cache key of a URL.
+func (b ban) matches(key string) bool {
+	host, uri := key, "/"
+	if i := strings.Index(key, "/"); i >= 0 {
+		host, uri = key[:i], key[i:]
+	}
+	return (b.host == "" || b.host == host) && b.pattern.MatchString(uri)
+}
+
+func (c *Cache) banned(entry *Entry) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, b := range c.bans {
+		if entry.Fetched.Before(b.at) && b.matches(entry.Key) {
+			return true
+		}
+	}
+	return false
+}
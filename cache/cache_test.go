@@ -0,0 +1,252 @@
+package cache
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"slashing/config"
+	"slashing/redis/hashmap"
+)
+
+func TestCacheHitAndVary(t *testing.T) {
+	var calls int32
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Vary", "Accept-Language")
+		w.Write([]byte("hello " + r.Header.Get("Accept-Language")))
+	})
+	handler := New(NewMemoryStore(1<<20)).Handler(upstream, &config.Cache{Enabled: true, MaxObject: 1 << 20})
+	get := func(lang string) (string, string) {
+		r := httptest.NewRequest("GET", "https://a.com/page", nil)
+		r.Header.Set("Accept-Language", lang)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Body.String(), w.Header().Get("X-Cache")
+	}
+	if body, state := get("en"); body != "hello en" || state != "MISS" {
+		t.Fatal("first request:", body, state)
+	}
+	if body, state := get("en"); body != "hello en" || state != "HIT" {
+		t.Fatal("second request:", body, state)
+	}
+	if body, _ := get("fr"); body != "hello fr" {
+		t.Fatal("another Accept-Language must not get the cached variant:", body)
+	}
+	if calls != 2 {
+		t.Fatal("expected 2 upstream calls, got", calls)
+	}
+}
+
+func TestCacheNoStore(t *testing.T) {
+	var calls int32
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.Header().Set("Cache-Control", "private, max-age=60")
+	})
+	for _, override := range []bool{false, true} {
+		calls = 0
+		handler := New(NewMemoryStore(1<<20)).Handler(upstream, &config.Cache{Enabled: true, TTL: time.Minute, Override: override, MaxObject: 1 << 20})
+		for i := 0; i < 2; i++ {
+			handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "https://a.com/", nil))
+		}
+		if calls != 2 {
+			t.Fatalf("private responses must not be cached, override %v", override)
+		}
+	}
+}
+
+func TestCacheCredentials(t *testing.T) {
+	var calls int32
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		if r.URL.Path == "/public" {
+			w.Header().Set("Cache-Control", "public, max-age=60")
+		} else {
+			w.Header().Set("Cache-Control", "max-age=60")
+		}
+		w.Write([]byte("hello " + r.Header.Get("Cookie")))
+	})
+	handler := New(NewMemoryStore(1<<20)).Handler(upstream, &config.Cache{Enabled: true, MaxObject: 1 << 20})
+	get := func(path, cookie string) (string, string) {
+		r := httptest.NewRequest("GET", "https://a.com"+path, nil)
+		if cookie != "" {
+			r.Header.Set("Cookie", cookie)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Body.String(), w.Header().Get("X-Cache")
+	}
+
+	get("/page", "session=alice")
+	if body, _ := get("/page", "session=bob"); body != "hello session=bob" {
+		t.Fatal("a response to a request with a cookie was shared:", body)
+	}
+	get("/page", "")
+	if body, state := get("/page", "session=bob"); body != "hello session=bob" || state != "MISS" {
+		t.Fatal("a request with a cookie got the anonymous response:", body, state)
+	}
+	if body, state := get("/page", ""); body != "hello " || state != "HIT" {
+		t.Fatal("anonymous requests should share their response:", body, state)
+	}
+
+	get("/public", "session=alice")
+	if body, state := get("/public", "session=bob"); body != "hello session=alice" || state != "HIT" {
+		t.Fatal("a public response should be shared:", body, state)
+	}
+}
+
+func TestCacheCoalescing(t *testing.T) {
+	var calls int32
+	release := make(chan struct{})
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("slow"))
+	})
+	handler := New(NewMemoryStore(1<<20)).Handler(upstream, &config.Cache{Enabled: true, MaxObject: 1 << 20})
+	wg := sync.WaitGroup{}
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest("GET", "https://a.com/slow", nil))
+			if w.Body.String() != "slow" {
+				t.Error("unexpected body", w.Body.String())
+			}
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if calls != 1 {
+		t.Fatal("concurrent requests should be coalesced, upstream saw", calls)
+	}
+}
+
+func TestCacheStaleIfErrorAndBan(t *testing.T) {
+	failing := false
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.Header().Set("Cache-Control", "max-age=0, stale-if-error=60")
+		w.Header().Set("Age", "1")
+		w.Write([]byte("good"))
+	})
+	c := New(NewMemoryStore(1 << 20))
+	handler := c.Handler(upstream, &config.Cache{Enabled: true, TTL: time.Minute, MaxObject: 1 << 20})
+	get := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "https://a.com/x", nil))
+		return w
+	}
+	get()
+	failing = true
+	if w := get(); w.Code != http.StatusOK || w.Body.String() != "good" || w.Header().Get("X-Cache") != "STALE" {
+		t.Fatal("stale entry should replace the error, got", w.Code, w.Body.String())
+	}
+	c.Ban("a.com", "^/x")
+	if w := get(); w.Code != http.StatusBadGateway {
+		t.Fatal("banned entry should not be served, got", w.Code)
+	}
+}
+
+func TestPurgeAndBanDeleteVariants(t *testing.T) {
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Vary", "Accept-Language")
+		w.Write([]byte("hello " + r.Header.Get("Accept-Language")))
+	})
+	store := NewMemoryStore(1 << 20)
+	c := New(store)
+	handler := c.Handler(upstream, &config.Cache{Enabled: true, MaxObject: 1 << 20})
+	fill := func() {
+		for _, target := range []string{"https://a.com/page", "https://a.com/other"} {
+			for _, lang := range []string{"en", "fr"} {
+				r := httptest.NewRequest("GET", target, nil)
+				r.Header.Set("Accept-Language", lang)
+				handler.ServeHTTP(httptest.NewRecorder(), r)
+			}
+		}
+	}
+	fill()
+	if keys := store.Keys(); len(keys) != 6 {
+		t.Fatalf("expected 2 meta entries and 4 variants, got %q", keys)
+	}
+	c.Purge("a.com/page")
+	if keys := store.Keys(); len(keys) != 3 {
+		t.Fatalf("purge should delete the variants of the URL, left %q", keys)
+	}
+	c.Ban("a.com", "^/")
+	if keys := store.Keys(); len(keys) != 0 {
+		t.Fatalf("ban should delete the matching entries, left %q", keys)
+	}
+}
+
+func TestDiskStoreLimits(t *testing.T) {
+	dir, err := ioutil.TempDir("", "slashing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := NewDiskStore(dir, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Set("short", make([]byte, 40), time.Minute)
+	store.Set("long", make([]byte, 40), time.Hour)
+	if value, ok := store.Get("long"); !ok || len(value) != 40 {
+		t.Fatal("expected the stored value back, got", value, ok)
+	}
+	store.Set("expired", []byte("x"), -time.Second)
+	if _, ok := store.Get("expired"); ok {
+		t.Fatal("expired entries must not be served")
+	}
+	store.Set("third", make([]byte, 40), time.Hour)
+	if _, ok := store.Get("short"); ok {
+		t.Fatal("the entry expiring first should have made room")
+	}
+	if keys := store.Keys(); len(keys) != 2 {
+		t.Fatalf("expected long and third left, got %q", keys)
+	}
+}
+
+func TestKVStoreLimits(t *testing.T) {
+	kv := hashmap.New()
+	kv.Set("other", "kept")
+	store := NewKVStore(kv, "cache:", 100)
+	store.Set("short", make([]byte, 40), time.Minute)
+	store.Set("long", make([]byte, 40), time.Hour)
+	store.Set("expired", []byte("x"), -time.Second)
+	if _, ok := store.Get("expired"); ok {
+		t.Fatal("expired entries must not be served")
+	}
+	if _, ok := kv.Get("cache:expired"); ok {
+		t.Fatal("expired entries should leave the KV store")
+	}
+	store.Set("third", make([]byte, 40), time.Hour)
+	if keys := store.Keys(); len(keys) != 2 {
+		t.Fatalf("expected long and third left, got %q", keys)
+	}
+
+	//values come back base64 encoded from a snapshot, and still expire
+	snapshot, _ := kv.ToJSON()
+	reloaded := hashmap.New()
+	reloaded.FromJSON(snapshot)
+	if value, ok := NewKVStore(reloaded, "cache:", 100).Get("long"); !ok || len(value) != 40 {
+		t.Fatal("expected the value back from the snapshot, got", value, ok)
+	}
+	if value, ok := reloaded.Get("other"); !ok || value != "kept" {
+		t.Fatal("the sweep must leave the other keys alone, got", value)
+	}
+}
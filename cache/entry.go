@@ -0,0 +1,181 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/gob"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"slashing/config"
+)
+
+// Entry is a cached response.
+type Entry struct {
+	Key    string
+	Status int
+	Header http.Header
+	Body   []byte
+
+	Stored               time.Time //when the response was generated, Age included
+	Fetched              time.Time //when slashing received it
+	TTL                  time.Duration
+	StaleWhileRevalidate time.Duration
+	StaleIfError         time.Duration
+	Public               bool //Cache-Control: public, the entry may answer requests with credentials
+}
+
+func (e *Entry) age(now time.Time) time.Duration {
+	return now.Sub(e.Stored)
+}
+
+func (e *Entry) fresh(now time.Time) bool {
+	return e.age(now) < e.TTL
+}
+
+// staleWithin reports whether the entry expired less than grace ago.
+func (e *Entry) staleWithin(now time.Time, grace time.Duration) bool {
+	return e.age(now) < e.TTL+grace
+}
+
+// lifetime is how long the entry may be served, stale or not.
+func (e *Entry) lifetime() time.Duration {
+	grace := e.StaleWhileRevalidate
+	if e.StaleIfError > grace {
+		grace = e.StaleIfError
+	}
+	return e.TTL + grace
+}
+
+func (e *Entry) encode() ([]byte, error) {
+	buf := &bytes.Buffer{}
+	err := gob.NewEncoder(buf).Encode(e)
+	return buf.Bytes(), err
+}
+
+func decodeEntry(data []byte) (*Entry, error) {
+	e := &Entry{}
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(e)
+	return e, err
+}
+
+// cacheableStatus lists the statuses a shared cache may keep by default.
+var cacheableStatus = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusNoContent:            true,
+	http.StatusMultipleChoices:      true,
+	http.StatusMovedPermanently:     true,
+	http.StatusPermanentRedirect:    true,
+	http.StatusNotFound:             true,
+	http.StatusGone:                 true,
+}
+
+// cacheableRequest reports whether a response to r may come from the cache.
+func cacheableRequest(r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	if r.Header.Get("Range") != "" {
+		return false
+	}
+	_, noStore := cacheControl(r.Header)["no-store"]
+	return !noStore
+}
+
+// credentialed reports whether r carries credentials. The response to it
+// may be meant for that user only, so it is only shared when it says it is
+// public.
+func credentialed(r *http.Request) bool {
+	return r.Header.Get("Authorization") != "" || r.Header.Get("Cookie") != ""
+}
+
+// newEntry decides whether a response may be cached and for how long.
+func newEntry(key string, status int, header http.Header, body []byte, rules *config.Cache, now time.Time) *Entry {
+	if !cacheableStatus[status] || header.Get("Set-Cookie") != "" || header.Get("Vary") == "*" {
+		return nil
+	}
+	e := &Entry{
+		Key:                  key,
+		Status:               status,
+		Header:               header.Clone(),
+		Body:                 body,
+		Stored:               now,
+		Fetched:              now,
+		TTL:                  rules.TTL,
+		StaleWhileRevalidate: rules.StaleWhileRevalidate,
+		StaleIfError:         rules.StaleIfError,
+	}
+	if age, err := strconv.Atoi(header.Get("Age")); err == nil && age > 0 {
+		e.Stored = now.Add(-time.Duration(age) * time.Second)
+	}
+	directives := cacheControl(header)
+	_, e.Public = directives["public"]
+	if rules.Override {
+		//a response for one user is never shared, whatever the rules say
+		if _, ok := directives["private"]; ok {
+			return nil
+		}
+		return e
+	}
+
+	for _, name := range []string{"no-store", "no-cache", "private"} {
+		if _, ok := directives[name]; ok {
+			return nil
+		}
+	}
+	if seconds, ok := directiveSeconds(directives, "s-maxage"); ok {
+		e.TTL = seconds
+	} else if seconds, ok := directiveSeconds(directives, "max-age"); ok {
+		e.TTL = seconds
+	} else if expires, err := http.ParseTime(header.Get("Expires")); err == nil {
+		date, err := http.ParseTime(header.Get("Date"))
+		if err != nil {
+			date = now
+		}
+		e.TTL = expires.Sub(date)
+	}
+	if seconds, ok := directiveSeconds(directives, "stale-while-revalidate"); ok {
+		e.StaleWhileRevalidate = seconds
+	}
+	if seconds, ok := directiveSeconds(directives, "stale-if-error"); ok {
+		e.StaleIfError = seconds
+	}
+	if e.TTL < 0 || e.lifetime() <= 0 {
+		return nil
+	}
+	return e
+}
+
+// cacheControl parses the Cache-Control directives of a header.
+func cacheControl(header http.Header) map[string]string {
+	directives := map[string]string{}
+	for _, value := range header.Values("Cache-Control") {
+		for _, directive := range strings.Split(value, ",") {
+			parts := strings.SplitN(strings.TrimSpace(directive), "=", 2)
+			name := strings.ToLower(parts[0])
+			if name == "" {
+				continue
+			}
+			if len(parts) == 2 {
+				directives[name] = strings.Trim(parts[1], `"`)
+			} else {
+				directives[name] = ""
+			}
+		}
+	}
+	return directives
+}
+
+func directiveSeconds(directives map[string]string, name string) (time.Duration, bool) {
+	value, ok := directives[name]
+	if !ok {
+		return 0, false
+	}
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || seconds < 0 {
+		return 0, false
+	}
+	return time.Duration(seconds) * time.Second, true
+}
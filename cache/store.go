@@ -0,0 +1,373 @@
+package cache
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"slashing/redis/hashmap"
+)
+
+// Store keeps encoded cache entries by key. An entry is gone once its ttl
+// is over, or earlier when the store is full.
+type Store interface {
+	Get(key string) ([]byte, bool)
+	Set(key string, value []byte, ttl time.Duration)
+	Delete(key string)
+	Keys() []string
+}
+
+// sweepInterval is how often the stores look for expired entries.
+const sweepInterval = time.Minute
+
+// storedItem is an entry as seen by a sweep.
+type storedItem struct {
+	key     string
+	size    int64
+	expires time.Time
+}
+
+// sweep removes the expired items, then the ones expiring first until the
+// rest fits in max. It returns the size left.
+func sweep(items []storedItem, max int64, now time.Time, remove func(key string)) int64 {
+	sort.Slice(items, func(i, j int) bool { return items[i].expires.Before(items[j].expires) })
+	size := int64(0)
+	for _, item := range items {
+		size += item.size
+	}
+	for _, item := range items {
+		if !now.After(item.expires) && size <= max {
+			break
+		}
+		remove(item.key)
+		size -= item.size
+	}
+	return size
+}
+
+// MemoryStore is an in-process store that drops the least recently used
+// entries once it holds more than its size in bytes.
+type MemoryStore struct {
+	sync.Mutex
+	max       int64
+	size      int64
+	order     *list.List //front is the most recently used
+	items     map[string]*list.Element
+	lastSweep time.Time
+}
+
+type memoryItem struct {
+	key     string
+	value   []byte
+	expires time.Time
+}
+
+func NewMemoryStore(max int64) *MemoryStore {
+	return &MemoryStore{max: max, order: list.New(), items: map[string]*list.Element{}, lastSweep: time.Now()}
+}
+
+func (s *MemoryStore) Get(key string) ([]byte, bool) {
+	s.Lock()
+	defer s.Unlock()
+	element, ok := s.items[key]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(element.Value.(*memoryItem).expires) {
+		s.remove(element)
+		return nil, false
+	}
+	s.order.MoveToFront(element)
+	return element.Value.(*memoryItem).value, true
+}
+
+func (s *MemoryStore) Set(key string, value []byte, ttl time.Duration) {
+	s.Lock()
+	defer s.Unlock()
+	if int64(len(value)) > s.max {
+		return
+	}
+	if element, ok := s.items[key]; ok {
+		s.remove(element)
+	}
+	now := time.Now()
+	s.items[key] = s.order.PushFront(&memoryItem{key: key, value: value, expires: now.Add(ttl)})
+	s.size += int64(len(value))
+	for s.size > s.max {
+		s.remove(s.order.Back())
+	}
+	if now.Sub(s.lastSweep) > sweepInterval {
+		for element := s.order.Front(); element != nil; {
+			next := element.Next()
+			if now.After(element.Value.(*memoryItem).expires) {
+				s.remove(element)
+			}
+			element = next
+		}
+		s.lastSweep = now
+	}
+}
+
+func (s *MemoryStore) Delete(key string) {
+	s.Lock()
+	defer s.Unlock()
+	if element, ok := s.items[key]; ok {
+		s.remove(element)
+	}
+}
+
+func (s *MemoryStore) Keys() []string {
+	s.Lock()
+	defer s.Unlock()
+	keys := make([]string, 0, len(s.items))
+	for key := range s.items {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func (s *MemoryStore) remove(element *list.Element) {
+	item := s.order.Remove(element).(*memoryItem)
+	delete(s.items, item.key)
+	s.size -= int64(len(item.value))
+}
+
+// DiskStore keeps one file per entry in a directory. A file holds the key on
+// its first line, then the value; its modification time is when it expires.
+// Once the files hold more than the size in bytes, those expiring first go.
+type DiskStore struct {
+	dir string
+	max int64
+
+	mu        sync.Mutex
+	size      int64 //of the files, as of the last sweep plus the writes since
+	lastSweep time.Time
+}
+
+func NewDiskStore(dir string, max int64) (*DiskStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	s := &DiskStore{dir: dir, max: max}
+	s.sweep(time.Now())
+	return s, nil
+}
+
+func (s *DiskStore) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(s.dir, hex.EncodeToString(sum[:]))
+}
+
+func (s *DiskStore) Get(key string) ([]byte, bool) {
+	name := s.path(key)
+	info, err := os.Stat(name)
+	if err != nil {
+		return nil, false
+	}
+	if time.Now().After(info.ModTime()) {
+		os.Remove(name)
+		return nil, false
+	}
+	data, err := ioutil.ReadFile(name)
+	if err != nil || !bytes.HasPrefix(data, []byte(key+"\n")) {
+		return nil, false
+	}
+	return data[len(key)+1:], true
+}
+
+func (s *DiskStore) Set(key string, value []byte, ttl time.Duration) {
+	if int64(len(key)+1+len(value)) > s.max {
+		return
+	}
+	//write aside and rename, so readers never see half a file
+	file, err := ioutil.TempFile(s.dir, "tmp-")
+	if err != nil {
+		return
+	}
+	_, err = file.Write(append([]byte(key+"\n"), value...))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	now := time.Now()
+	if err == nil {
+		err = os.Chtimes(file.Name(), now, now.Add(ttl))
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), s.path(key))
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return
+	}
+	s.mu.Lock()
+	s.size += int64(len(key) + 1 + len(value))
+	due := s.size > s.max || now.Sub(s.lastSweep) > sweepInterval
+	s.mu.Unlock()
+	if due {
+		s.sweep(now)
+	}
+}
+
+func (s *DiskStore) Delete(key string) {
+	os.Remove(s.path(key))
+}
+
+func (s *DiskStore) Keys() []string {
+	files, _ := ioutil.ReadDir(s.dir)
+	keys := []string{}
+	for _, info := range files {
+		if strings.HasPrefix(info.Name(), "tmp-") {
+			continue
+		}
+		file, err := os.Open(filepath.Join(s.dir, info.Name()))
+		if err != nil {
+			continue
+		}
+		key, err := bufio.NewReader(file).ReadString('\n')
+		file.Close()
+		if err == nil {
+			keys = append(keys, strings.TrimSuffix(key, "\n"))
+		}
+	}
+	return keys
+}
+
+// sweep removes the expired files and the leftovers of interrupted writes,
+// then shrinks the directory to its size.
+func (s *DiskStore) sweep(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return
+	}
+	items := []storedItem{}
+	for _, info := range files {
+		if strings.HasPrefix(info.Name(), "tmp-") {
+			if now.Sub(info.ModTime()) > sweepInterval {
+				os.Remove(filepath.Join(s.dir, info.Name()))
+			}
+			continue
+		}
+		items = append(items, storedItem{key: info.Name(), size: info.Size(), expires: info.ModTime()})
+	}
+	s.size = sweep(items, s.max, now, func(name string) {
+		os.Remove(filepath.Join(s.dir, name))
+	})
+	s.lastSweep = now
+}
+
+// KVStore keeps entries in the embedded Redis-compatible store, under a
+// key prefix. A value starts with its expiry time, so that entries reloaded
+// from a snapshot still expire. Once the values hold more than the size in
+// bytes, those expiring first go.
+type KVStore struct {
+	items  *hashmap.HashMap
+	prefix string
+	max    int64
+
+	mu        sync.Mutex
+	size      int64 //of the values, as of the last sweep plus the writes since
+	lastSweep time.Time
+}
+
+func NewKVStore(items *hashmap.HashMap, prefix string, max int64) *KVStore {
+	s := &KVStore{items: items, prefix: prefix, max: max}
+	s.sweep(time.Now())
+	return s
+}
+
+// get returns a stored value with its expiry header.
+func (s *KVStore) get(key string) ([]byte, bool) {
+	value, ok := s.items.Get(key)
+	if !ok {
+		return nil, false
+	}
+	var data []byte
+	switch v := value.(type) {
+	case []byte:
+		data = v
+	case string:
+		//values reloaded from the JSON snapshot come back base64 encoded
+		var err error
+		if data, err = base64.StdEncoding.DecodeString(v); err != nil {
+			return nil, false
+		}
+	}
+	return data, len(data) >= 8
+}
+
+func expiry(data []byte) time.Time {
+	return time.Unix(0, int64(binary.BigEndian.Uint64(data)))
+}
+
+func (s *KVStore) Get(key string) ([]byte, bool) {
+	data, ok := s.get(s.prefix + key)
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(expiry(data)) {
+		s.items.Del(s.prefix + key)
+		return nil, false
+	}
+	return data[8:], true
+}
+
+func (s *KVStore) Set(key string, value []byte, ttl time.Duration) {
+	if int64(8+len(value)) > s.max {
+		return
+	}
+	now := time.Now()
+	data := make([]byte, 8+len(value))
+	binary.BigEndian.PutUint64(data, uint64(now.Add(ttl).UnixNano()))
+	copy(data[8:], value)
+	s.items.Set(s.prefix+key, data)
+	s.mu.Lock()
+	s.size += int64(len(data))
+	due := s.size > s.max || now.Sub(s.lastSweep) > sweepInterval
+	s.mu.Unlock()
+	if due {
+		s.sweep(now)
+	}
+}
+
+func (s *KVStore) Delete(key string) {
+	s.items.Del(s.prefix + key)
+}
+
+func (s *KVStore) Keys() []string {
+	keys := []string{}
+	for _, k := range s.items.Keys() {
+		if key, ok := k.(string); ok && strings.HasPrefix(key, s.prefix) {
+			keys = append(keys, strings.TrimPrefix(key, s.prefix))
+		}
+	}
+	return keys
+}
+
+// sweep removes the expired values, then shrinks the entries to the size.
+func (s *KVStore) sweep(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	items := []storedItem{}
+	for _, key := range s.Keys() {
+		if data, ok := s.get(s.prefix + key); ok {
+			items = append(items, storedItem{key: s.prefix + key, size: int64(len(data)), expires: expiry(data)})
+		} else {
+			s.items.Del(s.prefix + key)
+		}
+	}
+	s.size = sweep(items, s.max, now, func(key string) { s.items.Del(key) })
+	s.lastSweep = now
+}
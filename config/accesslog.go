@@ -0,0 +1,63 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Access log formats.
+const (
+	AccessLogCombined = "combined"
+	AccessLogJSON     = "json"
+)
+
+// AccessLog configures the access log of a host.
+type AccessLog struct {
+	Path    string //empty when access logging is off
+	Format  string
+	MaxSize int64         //rotate before the file grows past it, 0 for no limit
+	Rotate  time.Duration //rotate when a new period starts, 0 for never
+	Keep    int           //rotated files kept, 0 for all
+}
+
+// parseAccessLog parses `access_log=/path [format=combined|json]
+// [max_size=100m] [rotate=24h] [keep=7]`, or `access_log=off`.
+func parseAccessLog(value string) (*AccessLog, error) {
+	path, options := Fields(value)
+	if path == "" {
+		return nil, fmt.Errorf("access_log needs a file or off")
+	}
+	if path == "off" {
+		return &AccessLog{}, nil
+	}
+	l := &AccessLog{Path: path, Format: AccessLogCombined, Keep: 7}
+	var err error
+	for key, v := range options {
+		switch key {
+		case "format":
+			l.Format = v
+			if v != AccessLogCombined && v != AccessLogJSON {
+				err = fmt.Errorf("access_log format must be combined or json, got %q", v)
+			}
+		case "max_size":
+			l.MaxSize, err = ParseSize(v)
+		case "rotate":
+			l.Rotate, err = time.ParseDuration(v)
+			if err == nil && l.Rotate <= 0 {
+				err = fmt.Errorf("access_log rotate must be positive")
+			}
+		case "keep":
+			l.Keep, err = strconv.Atoi(v)
+			if err == nil && l.Keep < 0 {
+				err = fmt.Errorf("access_log keep cannot be negative")
+			}
+		default:
+			err = fmt.Errorf("unknown access_log option %q", key)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return l, nil
+}
@@ -0,0 +1,84 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Authentication methods accepted by `auth=`.
+const (
+	AuthBasic   = "basic"
+	AuthJWT     = "jwt"
+	AuthForward = "forward"
+)
+
+// Auth configures the authentication of a route. An empty Type turns an
+// inherited authentication off.
+type Auth struct {
+	Type  string
+	File  string //basic: htpasswd file; jwt: JWKS file
+	Realm string //basic
+
+	Issuer   string //jwt: required iss claim, if set
+	Audience string //jwt: required aud claim, if set
+
+	URL     string        //forward: the auth service
+	Copy    []string      //forward: headers copied from its answer to the request
+	Timeout time.Duration //forward
+}
+
+func parseAuth(value string) (*Auth, error) {
+	method, options := Fields(value)
+	auth := &Auth{Type: method}
+	var err error
+	switch method {
+	case "off":
+		return &Auth{}, nil
+	case AuthBasic:
+		auth.Realm = "Restricted"
+	case AuthJWT:
+	case AuthForward:
+		auth.Timeout = 5 * time.Second
+	default:
+		return nil, fmt.Errorf("auth must be basic, jwt, forward or off, got %q", method)
+	}
+	for key, v := range options {
+		switch {
+		case key == "file" && method == AuthBasic, key == "jwks" && method == AuthJWT:
+			auth.File = v
+		case key == "realm" && method == AuthBasic:
+			auth.Realm = v
+		case key == "issuer" && method == AuthJWT:
+			auth.Issuer = v
+		case key == "audience" && method == AuthJWT:
+			auth.Audience = v
+		case key == "url" && method == AuthForward:
+			var u *url.URL
+			u, err = url.Parse(v)
+			if err == nil && (u.Scheme != "http" && u.Scheme != "https" || u.Host == "") {
+				err = fmt.Errorf("auth url must be an absolute http(s) URL, got %q", v)
+			}
+			auth.URL = v
+		case key == "copy" && method == AuthForward:
+			auth.Copy = strings.Split(v, ",")
+		case key == "timeout" && method == AuthForward:
+			auth.Timeout, err = time.ParseDuration(v)
+		default:
+			err = fmt.Errorf("unknown auth %s option %q", method, key)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	switch {
+	case method == AuthBasic && auth.File == "":
+		return nil, fmt.Errorf("auth=basic needs file=htpasswd")
+	case method == AuthJWT && auth.File == "":
+		return nil, fmt.Errorf("auth=jwt needs jwks=file")
+	case method == AuthForward && auth.URL == "":
+		return nil, fmt.Errorf("auth=forward needs url=")
+	}
+	return auth, nil
+}
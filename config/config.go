@@ -0,0 +1,751 @@
+package config
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultUpstream is the name of the pool formed by backend lines that appear
+// before any domain or upstream block.
+const DefaultUpstream = "default"
+
+// Config is the parsed content of a slashing configuration file.
+type Config struct {
+	Redis     Listen
+	RDBMS     Listen
+	Admin     string
+	Upstreams map[string]*Upstream //every pool, keyed by name (hosts use their domain)
+	Hosts     []*Host
+
+	TrustedProxies []*net.IPNet //peers whose forwarding headers are believed
+	ProxyProtocol  []*net.IPNet //peers whose PROXY protocol headers are read
+	CacheStore     *CacheStore  //nil for the default memory store
+	MaxConnsPerIP  int          //concurrent connections of one client IP, 0 for no limit
+	Streams        []*Stream    //TCP and UDP listeners
+	AccessLog      *AccessLog   //for the hosts without their own, and unknown hosts
+
+	Warnings []string //lines that were skipped, such as unknown keys
+}
+
+// errUnknownKey is returned by a directive the parser does not know. The
+// line is skipped with a warning, so that a config written for a newer
+// version, or with a typo, still loads.
+var errUnknownKey = errors.New("unknown key")
+
+// Upstream is a named pool of backends.
+type Upstream struct {
+	Name        string
+	Backends    []*Backend
+	HealthCheck *HealthCheck    //nil when the pool is not probed
+	Breaker     *CircuitBreaker //nil when live traffic does not eject backends
+	Balance     Balance
+	Sticky      *Sticky //nil when requests are not pinned to a backend
+
+	SendProxyProtocol int          //PROXY protocol version sent to backends, 0 for none
+	Retry             *Retry       //nil when failed requests are not retried
+	TLS               *UpstreamTLS //for https:// backends, nil for the system defaults
+	FastCGI           *FastCGI     //for fastcgi:// backends, nil for the defaults
+}
+
+// UpstreamTLS configures the TLS connections to the https:// backends of a
+// pool.
+type UpstreamTLS struct {
+	CA                 string //PEM bundle trusted instead of the system roots
+	ServerName         string //SNI and name verified, instead of the backend host
+	InsecureSkipVerify bool   //lab use only
+	Cert               string //client certificate for mutual TLS
+	Key                string
+}
+
+func parseUpstreamTLS(value string) (*UpstreamTLS, error) {
+	t := &UpstreamTLS{}
+	for key, v := range Options(value) {
+		switch key {
+		case "ca":
+			t.CA = v
+		case "server_name":
+			t.ServerName = v
+		case "insecure_skip_verify":
+			enabled, err := parseSwitch(v)
+			if err != nil {
+				return nil, err
+			}
+			t.InsecureSkipVerify = enabled
+		case "cert":
+			t.Cert = v
+		case "key":
+			t.Key = v
+		default:
+			return nil, fmt.Errorf("unknown tls option %q", key)
+		}
+	}
+	if (t.Cert == "") != (t.Key == "") {
+		return nil, fmt.Errorf("tls needs both cert= and key= for a client certificate")
+	}
+	return t, nil
+}
+
+// Retry configures the retry of failed requests on another backend.
+type Retry struct {
+	Attempts      int           //tries in total, the first one included
+	PerTryTimeout time.Duration //time a backend has to send response headers, 0 for no limit
+	Deadline      time.Duration //no retry is started after this, 0 for no limit
+	MaxBody       int64         //largest request body buffered for a retry
+}
+
+// Sticky pins clients to a backend with a signed affinity cookie.
+type Sticky struct {
+	Cookie string
+	Secret string        //HMAC key, random per process when empty
+	MaxAge time.Duration //0 makes it a session cookie
+}
+
+// Balance is the load-balancing method of a pool.
+type Balance struct {
+	Method string //one of the Balance* constants, empty for the default
+	Header string //hash key for BalanceHash
+	Cookie string //hash key for BalanceHash
+}
+
+// Load-balancing methods accepted by `balance=`.
+const (
+	BalanceRoundRobin         = "round_robin"
+	BalanceWeightedRoundRobin = "weighted_round_robin"
+	BalanceLeastConn          = "least_conn"
+	BalanceIPHash             = "ip_hash"
+	BalanceHash               = "hash"
+)
+
+// HealthCheck configures the active probing of every backend of a pool.
+type HealthCheck struct {
+	Path     string //empty for gRPC and TCP checks
+	GRPC     bool   //use the gRPC health checking protocol
+	TCP      bool   //only connect, for stream pools
+	Service  string //service asked about by gRPC checks, empty for the server
+	Interval time.Duration
+	Timeout  time.Duration
+	Rise     int //consecutive successes to mark a backend healthy
+	Fall     int //consecutive failures to mark a backend unhealthy
+}
+
+// Backend is a single `backend=` line.
+type Backend struct {
+	Address string //host:port, or unix:/path
+	Scheme  string //http, https, h2c or fastcgi
+	Weight  int
+	Options map[string]string
+}
+
+// Host is a `domain=` block.
+type Host struct {
+	Domain    string
+	Root      string
+	Upstream  *Upstream //the host's own pool, may have no backends
+	Locations []*Location
+	Options   RouteOptions //defaults of the requests of the domain
+
+	Rewrites      []*Rewrite  //applied in order before a location is picked
+	CanonicalHost string      //apex or www, empty to serve both names as they come
+	TrailingSlash string      //add or remove, empty to leave paths alone
+	AccessLog     *AccessLog  //nil to use the top level one
+	ErrorPages    *ErrorPages //nil for the plain error responses
+}
+
+// Load reads and parses the configuration file at path.
+func Load(path string) (*Config, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return Parse(file)
+}
+
+// Parse reads a configuration from r.
+//
+// The file is a list of key=value lines. `upstream=name` and `domain=host:root`
+// open a block; the lines following a block belong to it until the next block.
+func Parse(r io.Reader) (*Config, error) {
+	cfg := &Config{Upstreams: map[string]*Upstream{}}
+	cfg.Upstreams[DefaultUpstream] = &Upstream{Name: DefaultUpstream}
+
+	p := &parser{cfg: cfg, upstream: cfg.Upstreams[DefaultUpstream]}
+	scanner := bufio.NewScanner(r)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.Trim(scanner.Text(), " \t\r\n")
+		if line == "" || string(line[0]) == "#" {
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("line %d: expected key=value, got %q", lineNo, line)
+		}
+		key := strings.TrimSpace(parts[0])
+		if err := p.directive(key, strings.TrimSpace(parts[1])); err == errUnknownKey {
+			cfg.Warnings = append(cfg.Warnings, fmt.Sprintf("line %d: unknown key %q, skipped", lineNo, key))
+		} else if err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineNo, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return cfg, cfg.validate()
+}
+
+type parser struct {
+	cfg      *Config
+	host     *Host     //current domain block, nil outside of one
+	location *Location //current location of the domain block, if any
+	upstream *Upstream //pool that receives backend lines
+}
+
+func (p *parser) directive(key, value string) error {
+	switch key {
+	case "redis", "rdbms":
+		l, err := parseListen(value)
+		if err != nil {
+			return fmt.Errorf("%s: %v", key, err)
+		}
+		if key == "redis" {
+			p.cfg.Redis = l
+		} else {
+			p.cfg.RDBMS = l
+		}
+	case "admin":
+		p.cfg.Admin = value
+	case "trusted_proxies":
+		nets, err := parseCIDRs(value)
+		if err != nil {
+			return err
+		}
+		p.cfg.TrustedProxies = append(p.cfg.TrustedProxies, nets...)
+	case "proxy_protocol":
+		nets, err := parseCIDRs(value)
+		if err != nil {
+			return err
+		}
+		p.cfg.ProxyProtocol = append(p.cfg.ProxyProtocol, nets...)
+	case "max_conns_per_ip":
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return fmt.Errorf("max_conns_per_ip expects a number, got %q", value)
+		}
+		p.cfg.MaxConnsPerIP = n
+	case "cache_store":
+		store, err := parseCacheStore(value)
+		if err != nil {
+			return err
+		}
+		p.cfg.CacheStore = store
+	case "upstream":
+		if value == "" {
+			return fmt.Errorf("upstream needs a name")
+		}
+		if _, ok := p.cfg.Upstreams[value]; ok {
+			return fmt.Errorf("upstream %q declared twice", value)
+		}
+		p.upstream = &Upstream{Name: value}
+		p.cfg.Upstreams[value] = p.upstream
+		p.host, p.location = nil, nil
+	case "domain":
+		valueParts := strings.SplitN(value, ":", 2)
+		host := &Host{Domain: strings.ToLower(valueParts[0])}
+		if len(valueParts) == 2 {
+			host.Root = valueParts[1]
+		}
+		if _, ok := p.cfg.Upstreams[host.Domain]; ok {
+			return fmt.Errorf("domain %q clashes with an existing upstream", host.Domain)
+		}
+		host.Upstream = &Upstream{Name: host.Domain}
+		p.cfg.Upstreams[host.Domain] = host.Upstream
+		p.cfg.Hosts = append(p.cfg.Hosts, host)
+		p.host, p.location = host, nil
+		p.upstream = host.Upstream
+	case "backend":
+		address, options := Fields(value)
+		if address == "" {
+			return fmt.Errorf("backend needs an address")
+		}
+		backend := &Backend{Address: address, Scheme: "http", Weight: 1, Options: options}
+		if i := strings.Index(address, "://"); i >= 0 {
+			backend.Scheme, backend.Address = address[:i], strings.TrimSuffix(address[i+3:], "/")
+			if backend.Scheme != "http" && backend.Scheme != "https" && backend.Scheme != "h2c" && backend.Scheme != "fastcgi" {
+				return fmt.Errorf("backend scheme must be http, https, h2c or fastcgi, got %q", backend.Scheme)
+			}
+		}
+		if backend.Address == "unix:" {
+			return fmt.Errorf("backend unix socket needs a path")
+		}
+		if weight, ok := options["weight"]; ok {
+			n, err := strconv.Atoi(weight)
+			if err != nil || n < 1 {
+				return fmt.Errorf("backend weight must be a positive integer, got %q", weight)
+			}
+			backend.Weight = n
+		}
+		p.upstream.Backends = append(p.upstream.Backends, backend)
+	case "health_check":
+		check, err := parseHealthCheck(value)
+		if err != nil {
+			return err
+		}
+		p.upstream.HealthCheck = check
+	case "circuit_breaker":
+		breaker, err := parseCircuitBreaker(value)
+		if err != nil {
+			return err
+		}
+		p.upstream.Breaker = breaker
+	case "balance":
+		balance, err := parseBalance(value)
+		if err != nil {
+			return err
+		}
+		p.upstream.Balance = balance
+	case "sticky":
+		sticky, err := parseSticky(value)
+		if err != nil {
+			return err
+		}
+		p.upstream.Sticky = sticky
+	case "send_proxy_protocol":
+		switch value {
+		case "v1":
+			p.upstream.SendProxyProtocol = 1
+		case "v2":
+			p.upstream.SendProxyProtocol = 2
+		default:
+			return fmt.Errorf("send_proxy_protocol expects v1 or v2, got %q", value)
+		}
+	case "retry":
+		retry, err := parseRetry(value)
+		if err != nil {
+			return err
+		}
+		p.upstream.Retry = retry
+	case "rewrite", "canonical_host", "trailing_slash":
+		return p.rewriteDirective(key, value)
+	case "error_page", "intercept_errors", "maintenance_page":
+		return p.errorPageDirective(key, value)
+	case "fastcgi":
+		fastCGI, err := parseFastCGI(value)
+		if err != nil {
+			return err
+		}
+		p.upstream.FastCGI = fastCGI
+	case "stream":
+		return p.streamDirective(value)
+	case "access_log":
+		l, err := parseAccessLog(value)
+		if err != nil {
+			return err
+		}
+		if p.host != nil {
+			p.host.AccessLog = l
+		} else {
+			p.cfg.AccessLog = l
+		}
+	case "tls":
+		t, err := parseUpstreamTLS(value)
+		if err != nil {
+			return err
+		}
+		p.upstream.TLS = t
+	case "location":
+		if p.host == nil {
+			return fmt.Errorf("location must be inside a domain block")
+		}
+		location, err := parseLocation(value)
+		if err != nil {
+			return err
+		}
+		p.host.Locations = append(p.host.Locations, location)
+		p.location = location
+	case "proxy", "static", "redirect", "respond", "strip_prefix":
+		if p.host == nil {
+			return fmt.Errorf("%s must be inside a domain block", key)
+		}
+		if p.location == nil {
+			if key != "proxy" {
+				return fmt.Errorf("%s must be inside a location", key)
+			}
+			//proxy=/prefix upstream is short for a prefix location
+			fields := strings.Fields(value)
+			if len(fields) != 2 {
+				return fmt.Errorf("proxy outside of a location expects `proxy=/prefix upstream`")
+			}
+			location := &Location{Match: MatchPrefix, Pattern: fields[0], Action: ActionProxy, Upstream: fields[1]}
+			p.host.Locations = append(p.host.Locations, location)
+			return nil
+		}
+		return p.location.action(key, value)
+	case "cache":
+		options, err := p.routeOptions(key)
+		if err != nil {
+			return err
+		}
+		if options.Cache, err = parseCache(value); err != nil {
+			return err
+		}
+	case "compress":
+		options, err := p.routeOptions(key)
+		if err != nil {
+			return err
+		}
+		if options.Compress, err = parseCompress(value); err != nil {
+			return err
+		}
+	case "rate_limit":
+		options, err := p.routeOptions(key)
+		if err != nil {
+			return err
+		}
+		if options.RateLimit, err = parseRateLimit(value); err != nil {
+			return err
+		}
+	case "auth":
+		options, err := p.routeOptions(key)
+		if err != nil {
+			return err
+		}
+		if options.Auth, err = parseAuth(value); err != nil {
+			return err
+		}
+	case "split":
+		options, err := p.routeOptions(key)
+		if err != nil {
+			return err
+		}
+		if options.Split, err = parseSplit(value); err != nil {
+			return err
+		}
+	case "mirror":
+		options, err := p.routeOptions(key)
+		if err != nil {
+			return err
+		}
+		if options.Mirror, err = parseMirror(value); err != nil {
+			return err
+		}
+	case "request_header", "response_header":
+		options, err := p.routeOptions(key)
+		if err != nil {
+			return err
+		}
+		rule, err := parseHeaderRule(value)
+		if err != nil {
+			return err
+		}
+		if key == "request_header" {
+			options.RequestHeaders = append(options.RequestHeaders, rule)
+		} else {
+			options.ResponseHeaders = append(options.ResponseHeaders, rule)
+		}
+	default:
+		return errUnknownKey
+	}
+	return nil
+}
+
+func (cfg *Config) validate() error {
+	for _, upstream := range cfg.Upstreams {
+		for _, backend := range upstream.Backends {
+			if protocol(backend.Scheme) != protocol(upstream.Backends[0].Scheme) {
+				return fmt.Errorf("upstream %s mixes %s and %s backends", upstream.Name, backend.Scheme, upstream.Backends[0].Scheme)
+			}
+		}
+		if len(upstream.Backends) == 0 {
+			continue
+		}
+		switch scheme := upstream.Backends[0].Scheme; {
+		case scheme == "h2c" && upstream.SendProxyProtocol != 0:
+			//a connection to an h2c backend carries the requests of many clients
+			return fmt.Errorf("upstream %s: send_proxy_protocol does not work with h2c backends", upstream.Name)
+		case upstream.HealthCheck != nil && upstream.HealthCheck.GRPC && scheme != "h2c" && scheme != "https":
+			return fmt.Errorf("upstream %s: gRPC health checks need h2c or https backends", upstream.Name)
+		}
+	}
+	for _, host := range cfg.Hosts {
+		if pages := host.ErrorPages; pages != nil && pages.Intercept && len(pages.Pages) == 0 {
+			return fmt.Errorf("domain %s: intercept_errors needs error_page lines", host.Domain)
+		}
+		if split := host.Options.Split; split != nil && split.Upstream != "" && cfg.Upstreams[split.Upstream] == nil {
+			return fmt.Errorf("domain %s: split to unknown upstream %q", host.Domain, split.Upstream)
+		}
+		if err := cfg.validateMirror(host.Options.Mirror); err != nil {
+			return fmt.Errorf("domain %s: %v", host.Domain, err)
+		}
+		for _, location := range host.Locations {
+			if split := location.Options.Split; split != nil && split.Upstream != "" && cfg.Upstreams[split.Upstream] == nil {
+				return fmt.Errorf("domain %s: location %s splits to unknown upstream %q", host.Domain, location.Pattern, split.Upstream)
+			}
+			if err := cfg.validateMirror(location.Options.Mirror); err != nil {
+				return fmt.Errorf("domain %s: location %s: %v", host.Domain, location.Pattern, err)
+			}
+			if location.Action == "" {
+				return fmt.Errorf("domain %s: location %s has no static, proxy, redirect or respond line", host.Domain, location.Pattern)
+			}
+			if location.Action != ActionProxy {
+				continue
+			}
+			if location.Upstream == "" {
+				location.Upstream = host.Domain
+			}
+			if _, ok := cfg.Upstreams[location.Upstream]; !ok {
+				return fmt.Errorf("domain %s: location %s refers to unknown upstream %q", host.Domain, location.Pattern, location.Upstream)
+			}
+		}
+	}
+	return cfg.validateStreams()
+}
+
+// validateMirror checks the shadow pool of a mirror. Shadow requests are
+// plain HTTP requests, which FastCGI backends do not speak.
+func (cfg *Config) validateMirror(mirror *Mirror) error {
+	if mirror == nil || mirror.Upstream == "" {
+		return nil
+	}
+	upstream := cfg.Upstreams[mirror.Upstream]
+	switch {
+	case upstream == nil:
+		return fmt.Errorf("mirror to unknown upstream %q", mirror.Upstream)
+	case len(upstream.Backends) > 0 && upstream.Backends[0].Scheme == "fastcgi":
+		return fmt.Errorf("mirror to FastCGI upstream %q, only HTTP pools can take shadow requests", mirror.Upstream)
+	}
+	return nil
+}
+
+// parseCIDRs parses a list of networks. A bare IP is a network of its own.
+func parseCIDRs(value string) ([]*net.IPNet, error) {
+	nets := []*net.IPNet{}
+	for _, field := range strings.Fields(value) {
+		if !strings.Contains(field, "/") {
+			ip := net.ParseIP(field)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address %q", field)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(field)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, network)
+	}
+	return nets, nil
+}
+
+// protocol groups the backend schemes that one pool transport can serve.
+func protocol(scheme string) string {
+	if scheme == "https" {
+		return "http"
+	}
+	return scheme
+}
+
+func parseHealthCheck(value string) (*HealthCheck, error) {
+	path, options := Fields(value)
+	check := &HealthCheck{Path: path, Interval: 5 * time.Second, Timeout: 2 * time.Second, Rise: 2, Fall: 3}
+	if path == "grpc" {
+		check.Path, check.GRPC = "", true
+	} else if path == "tcp" {
+		check.Path, check.TCP = "", true
+	} else if !strings.HasPrefix(path, "/") {
+		return nil, fmt.Errorf("health_check expects a path starting with /, grpc or tcp, got %q", path)
+	}
+	var err error
+	for key, v := range options {
+		switch key {
+		case "service":
+			if !check.GRPC {
+				err = fmt.Errorf("health_check service is only for grpc checks")
+			}
+			check.Service = v
+		case "interval":
+			check.Interval, err = time.ParseDuration(v)
+		case "timeout":
+			check.Timeout, err = time.ParseDuration(v)
+		case "rise":
+			check.Rise, err = strconv.Atoi(v)
+		case "fall":
+			check.Fall, err = strconv.Atoi(v)
+		default:
+			err = fmt.Errorf("unknown health_check option %q", key)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if check.Interval <= 0 || check.Timeout <= 0 || check.Rise < 1 || check.Fall < 1 {
+		return nil, fmt.Errorf("health_check interval, timeout, rise and fall must be positive")
+	}
+	return check, nil
+}
+
+func parseBalance(value string) (Balance, error) {
+	method, options := Fields(value)
+	balance := Balance{Method: method, Header: options["header"], Cookie: options["cookie"]}
+	switch method {
+	case BalanceRoundRobin, BalanceWeightedRoundRobin, BalanceLeastConn, BalanceIPHash:
+		if len(options) > 0 {
+			return balance, fmt.Errorf("balance %s takes no options", method)
+		}
+	case BalanceHash:
+		if len(options) != 1 || (balance.Header == "" && balance.Cookie == "") {
+			return balance, fmt.Errorf("balance hash needs either header=Name or cookie=name")
+		}
+	default:
+		return balance, fmt.Errorf("unknown balance method %q", method)
+	}
+	return balance, nil
+}
+
+func parseSticky(value string) (*Sticky, error) {
+	cookie, options := Fields(value)
+	if cookie == "" || strings.Contains(cookie, "=") {
+		return nil, fmt.Errorf("sticky expects a cookie name first, e.g. `sticky=SLASHING_ID secret=...`")
+	}
+	sticky := &Sticky{Cookie: cookie}
+	var err error
+	for key, v := range options {
+		switch key {
+		case "secret":
+			sticky.Secret = v
+		case "max_age":
+			sticky.MaxAge, err = time.ParseDuration(v)
+		default:
+			err = fmt.Errorf("unknown sticky option %q", key)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return sticky, nil
+}
+
+func parseRetry(value string) (*Retry, error) {
+	attempts, options := Fields(value)
+	n, err := strconv.Atoi(attempts)
+	if err != nil || n < 2 {
+		return nil, fmt.Errorf("retry expects the number of tries (2 or more) first, got %q", attempts)
+	}
+	retry := &Retry{Attempts: n, MaxBody: 64 << 10}
+	for key, v := range options {
+		switch key {
+		case "per_try_timeout":
+			retry.PerTryTimeout, err = time.ParseDuration(v)
+		case "deadline":
+			retry.Deadline, err = time.ParseDuration(v)
+		case "max_body":
+			retry.MaxBody, err = ParseSize(v)
+		default:
+			err = fmt.Errorf("unknown retry option %q", key)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return retry, nil
+}
+
+// ParseSize parses a byte size such as 512, 64k, 10m or 1g.
+func ParseSize(value string) (int64, error) {
+	if value == "" {
+		return 0, fmt.Errorf("empty size")
+	}
+	multiplier := int64(1)
+	switch strings.ToLower(value[len(value)-1:]) {
+	case "k":
+		multiplier = 1 << 10
+	case "m":
+		multiplier = 1 << 20
+	case "g":
+		multiplier = 1 << 30
+	}
+	if multiplier != 1 {
+		value = value[:len(value)-1]
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+	return n * multiplier, nil
+}
+
+// CircuitBreaker configures the passive health check of a pool's backends.
+type CircuitBreaker struct {
+	MaxFails int           //failures within Window that eject a backend
+	Window   time.Duration //window in which failures are counted
+	Cooldown time.Duration //time an ejected backend gets no traffic
+	HalfOpen int           //trial requests that must succeed to restore it
+}
+
+func parseCircuitBreaker(value string) (*CircuitBreaker, error) {
+	breaker := &CircuitBreaker{MaxFails: 5, Window: 10 * time.Second, Cooldown: 30 * time.Second, HalfOpen: 3}
+	var err error
+	for key, v := range Options(value) {
+		switch key {
+		case "max_fails":
+			breaker.MaxFails, err = strconv.Atoi(v)
+		case "window":
+			breaker.Window, err = time.ParseDuration(v)
+		case "cooldown":
+			breaker.Cooldown, err = time.ParseDuration(v)
+		case "half_open":
+			breaker.HalfOpen, err = strconv.Atoi(v)
+		case "on":
+		default:
+			err = fmt.Errorf("unknown circuit_breaker option %q", key)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if breaker.MaxFails < 1 || breaker.Window <= 0 || breaker.Cooldown <= 0 || breaker.HalfOpen < 1 {
+		return nil, fmt.Errorf("circuit_breaker max_fails, window, cooldown and half_open must be positive")
+	}
+	return breaker, nil
+}
+
+// Fields splits a value into its first word and trailing key=value options.
+// A bare option word is stored with the value "on".
+func Fields(value string) (string, map[string]string) {
+	fields := strings.Fields(value)
+	if len(fields) == 0 {
+		return "", map[string]string{}
+	}
+	return fields[0], options(fields[1:])
+}
+
+// Options parses a value made only of key=value options.
+func Options(value string) map[string]string {
+	return options(strings.Fields(value))
+}
+
+func options(fields []string) map[string]string {
+	options := map[string]string{}
+	for _, field := range fields {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) == 2 {
+			options[kv[0]] = kv[1]
+		} else {
+			options[kv[0]] = "on"
+		}
+	}
+	return options
+}
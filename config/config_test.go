@@ -0,0 +1,211 @@
+package config
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseBlocks(t *testing.T) {
+	cfg, err := Parse(strings.NewReader(`
+backend=127.0.0.1:9527
+redis=127.0.0.1:10060
+rdbms=unix:/run/slashing/sql.sock mode=0660
+upstream=api
+backend=127.0.0.1:9000
+backend=https://127.0.0.1:9001/ weight=3
+upstream=app
+backend=unix:/run/app.sock
+domain=Example.com:/var/www/example
+backend=127.0.0.1:8080
+proxy=/api/ api
+domain=static.example.com:/var/www/static
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Redis.Address != "127.0.0.1:10060" {
+		t.Fatal("redis address not parsed:", cfg.Redis)
+	}
+	if network, address := cfg.RDBMS.Addr(); network != "unix" || address != "/run/slashing/sql.sock" || cfg.RDBMS.Mode != 0660 {
+		t.Fatalf("rdbms socket parsed wrongly: %+v", cfg.RDBMS)
+	}
+	if len(cfg.Upstreams[DefaultUpstream].Backends) != 1 {
+		t.Fatal("top level backend should go to the default upstream")
+	}
+	api := cfg.Upstreams["api"]
+	if len(api.Backends) != 2 || api.Backends[1].Options["weight"] != "3" {
+		t.Fatalf("api upstream parsed wrongly: %+v", api.Backends)
+	}
+	if b := api.Backends[1]; b.Scheme != "https" || b.Address != "127.0.0.1:9001" || api.Backends[0].Scheme != "http" {
+		t.Fatalf("backend scheme parsed wrongly: %+v", b)
+	}
+	if len(cfg.Hosts) != 2 {
+		t.Fatal("expected 2 hosts, got", len(cfg.Hosts))
+	}
+	if b := cfg.Upstreams["app"].Backends[0]; b.Scheme != "http" || b.Address != "unix:/run/app.sock" {
+		t.Fatalf("unix socket backend parsed wrongly: %+v", b)
+	}
+	host := cfg.Hosts[0]
+	if host.Domain != "example.com" || host.Root != "/var/www/example" {
+		t.Fatalf("domain parsed wrongly: %+v", host)
+	}
+	if len(host.Upstream.Backends) != 1 || host.Upstream.Backends[0].Address != "127.0.0.1:8080" {
+		t.Fatal("backend inside a domain block should go to the host's pool")
+	}
+	if len(host.Locations) != 1 || host.Locations[0].Upstream != "api" || host.Locations[0].Match != MatchPrefix {
+		t.Fatal("proxy line not parsed")
+	}
+	if len(cfg.Hosts[1].Upstream.Backends) != 0 {
+		t.Fatal("static host should have no backends")
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, input := range []string{
+		"nonsense",
+		"proxy=/api/ api",
+		"domain=a.com\nproxy=/api/ missing",
+		"upstream=api\nupstream=api",
+		"domain=a.com\nlocation=prefix /a/",
+		"domain=a.com\nlocation=glob /a/*\nstatic=/var/www",
+		"domain=a.com\nlocation=regex ^/(\nstatic=/var/www",
+		"domain=a.com\nlocation=exact /a\nredirect=200 /b",
+		"domain=a.com\nlocation=exact /a\nstatic=/var/www\nrespond=200",
+		"domain=a.com\nstatic=/var/www",
+		"domain=a.com\nrate_limit=10",
+		"domain=a.com\nrate_limit=10/d",
+		"domain=a.com\nrate_limit=10/s key=query:q",
+		"max_conns_per_ip=many",
+		"domain=a.com\nauth=basic",
+		"domain=a.com\nauth=jwt file=keys.json",
+		"domain=a.com\nauth=forward url=/relative",
+		"domain=a.com\nauth=ldap",
+		"domain=a.com\nrewrite=^/a/(.*) https://b.com/$1",
+		"domain=a.com\nrewrite=^/a/ /b/ code=200",
+		"domain=a.com\ncanonical_host=example.com",
+		"domain=a.com\nresponse_header=replace Server x",
+		"domain=a.com\nresponse_header=remove Server now",
+		"domain=a.com\nrequest_header=set X-Tenant",
+		"domain=a.com\nsplit=canary 10",
+		"upstream=canary\ndomain=a.com\nsplit=canary 110",
+		"domain=a.com\nmirror=shadow",
+		"backend=ftp://127.0.0.1:21",
+		"upstream=api\ntls=cert=client.pem",
+		"upstream=shadow\ndomain=a.com\nmirror=shadow sample=half",
+		"upstream=shadow\nbackend=fastcgi://127.0.0.1:9000\ndomain=a.com\nmirror=shadow",
+		"backend=fastcgi://127.0.0.1:9000\nbackend=127.0.0.1:80",
+		"upstream=php\nfastcgi=idnex=index.php",
+		"upstream=php\nfastcgi=split_path=\\.php$",
+		"backend=h2c://127.0.0.1:50051\nbackend=127.0.0.1:80",
+		"backend=h2c://127.0.0.1:50051\nsend_proxy_protocol=v2",
+		"backend=127.0.0.1:80\nhealth_check=grpc",
+		"backend=h2c://127.0.0.1:50051\nhealth_check=/healthz service=echo",
+		"backend=unix:",
+		"redis=127.0.0.1:10060 mode=0660",
+		"rdbms=unix:/run/sql.sock mode=rw",
+		"upstream=db\nstream=tcp :5432",
+		"upstream=db\nstream=sctp :5432 upstream=db",
+		"upstream=db\nstream=tcp 5432 upstream=db",
+		"stream=tcp :5432 upstream=missing",
+		"upstream=db\nstream=tcp :5432 upstream=db\nstream=tcp :5432 upstream=db",
+		"upstream=dns\nstream=udp :53 upstream=dns sni=a.com",
+		"upstream=db\nstream=tcp :5432 upstream=db cert=a.pem",
+		"upstream=web\nbackend=https://10.0.0.1:443\nstream=tcp :443 upstream=web",
+		"upstream=git\nstream=tcp :443 sni=git.*.com upstream=git",
+		"domain=a.com\nupstream=web\nstream=tcp :443 upstream=web",
+		"access_log=",
+		"access_log=/var/log/slashing.log format=xml",
+		"access_log=/var/log/slashing.log keep=-1",
+		"access_log=/var/log/slashing.log max_size=big",
+		"access_log=/var/log/slashing.log rotate=0s",
+		"error_page=404 /var/www/404.html",
+		"domain=a.com\nerror_page=/var/www/404.html",
+		"domain=a.com\nerror_page=302 /var/www/302.html",
+		"domain=a.com\nintercept_errors=on",
+		"domain=a.com\nmaintenance_page=/var/www/down.html retry_after=soon",
+	} {
+		if _, err := Parse(strings.NewReader(input)); err == nil {
+			t.Errorf("expected an error for %q", input)
+		}
+	}
+}
+
+func TestParseUnknownKeys(t *testing.T) {
+	cfg, err := Parse(strings.NewReader("domain=a.com\nbakend=127.0.0.1:80\nfuture_option=on\n"))
+	if err != nil {
+		t.Fatal("unknown keys should not stop the config from loading:", err)
+	}
+	want := []string{`line 2: unknown key "bakend", skipped`, `line 3: unknown key "future_option", skipped`}
+	if strings.Join(cfg.Warnings, "\n") != strings.Join(want, "\n") {
+		t.Errorf("expected a warning per unknown key, got %q", cfg.Warnings)
+	}
+}
+
+func TestParseHeaderRuleErrors(t *testing.T) {
+	for _, rule := range []string{"replace Server x", "remove Server now", "set X-Tenant"} {
+		_, err := parseHeaderRule(rule)
+		if err == nil || !strings.Contains(err.Error(), `"`+rule+`"`) {
+			t.Errorf("the error for %q should quote the rule, got %v", rule, err)
+		}
+	}
+}
+
+func TestParseLocations(t *testing.T) {
+	cfg, err := Parse(strings.NewReader(`
+domain=example.com:/var/www/example
+location=exact /healthz
+respond=200 ok then
+location=regex ^/old/(.*)$
+redirect=301 /new/$1
+location=prefix /assets/
+static=/var/www/assets
+strip_prefix=on
+location=prefix /
+proxy=
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	locations := cfg.Hosts[0].Locations
+	if len(locations) != 4 {
+		t.Fatal("expected 4 locations, got", len(locations))
+	}
+	if l := locations[0]; l.Action != ActionRespond || l.Code != 200 || l.Target != "ok then" {
+		t.Fatalf("respond parsed wrongly: %+v", l)
+	}
+	if l := locations[1]; l.Regexp == nil || l.Code != 301 || l.Target != "/new/$1" {
+		t.Fatalf("redirect parsed wrongly: %+v", l)
+	}
+	if l := locations[2]; l.Root != "/var/www/assets" || !l.StripPrefix {
+		t.Fatalf("static parsed wrongly: %+v", l)
+	}
+	if l := locations[3]; l.Upstream != "example.com" {
+		t.Fatal("proxy without a name should use the domain pool, got", l.Upstream)
+	}
+}
+
+func TestParseStreams(t *testing.T) {
+	cfg, err := Parse(strings.NewReader(`
+upstream=git
+backend=10.0.0.1:443
+upstream=dns
+backend=10.0.0.2:53
+stream=tcp :443 sni=Git.Example.com upstream=git
+stream=tcp :443 sni=*.apps.example.com upstream=git cert=apps.pem key=apps.key
+stream=udp :53 upstream=dns
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Streams) != 2 {
+		t.Fatal("lines of the same address should share a stream, got", len(cfg.Streams))
+	}
+	tcp, udp := cfg.Streams[0], cfg.Streams[1]
+	if !tcp.SharesHTTPS() || len(tcp.Routes) != 2 || tcp.Routes[0].SNI != "git.example.com" || tcp.Routes[1].Cert != "apps.pem" {
+		t.Fatalf("tcp stream parsed wrongly: %+v", tcp)
+	}
+	if udp.SharesHTTPS() || udp.Timeout != 30*time.Second || udp.Routes[0].Upstream != "dns" {
+		t.Fatalf("udp stream parsed wrongly: %+v", udp)
+	}
+}
@@ -0,0 +1,68 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrorPages are the HTML pages a domain shows instead of bare error
+// responses.
+type ErrorPages struct {
+	Pages       map[int]string //file of each error status
+	Intercept   bool           //also replace the error responses of the backends
+	Maintenance string         //file shown with 503 when a pool has no healthy backend
+	RetryAfter  time.Duration  //Retry-After of the maintenance page, 0 for none
+}
+
+// errorPageDirective handles `error_page=404 /path`, `error_page=500 502
+// /path`, `intercept_errors=on` and `maintenance_page=/path [retry_after=]`.
+// Like the rewrites, they belong to the domain even inside a location.
+func (p *parser) errorPageDirective(key, value string) error {
+	if p.host == nil {
+		return fmt.Errorf("%s must be inside a domain block", key)
+	}
+	if p.host.ErrorPages == nil {
+		p.host.ErrorPages = &ErrorPages{Pages: map[int]string{}}
+	}
+	pages := p.host.ErrorPages
+	switch key {
+	case "error_page":
+		fields := strings.Fields(value)
+		if len(fields) < 2 {
+			return fmt.Errorf("error_page expects status codes and a file, got %q", value)
+		}
+		file := fields[len(fields)-1]
+		for _, field := range fields[:len(fields)-1] {
+			code, err := strconv.Atoi(field)
+			if err != nil || code < 400 || code > 599 {
+				return fmt.Errorf("error_page status must be 4xx or 5xx, got %q", field)
+			}
+			pages.Pages[code] = file
+		}
+	case "intercept_errors":
+		enabled, err := parseSwitch(value)
+		if err != nil {
+			return err
+		}
+		pages.Intercept = enabled
+	case "maintenance_page":
+		file, options := Fields(value)
+		if file == "" {
+			return fmt.Errorf("maintenance_page needs a file")
+		}
+		pages.Maintenance = file
+		for key, v := range options {
+			if key != "retry_after" {
+				return fmt.Errorf("unknown maintenance_page option %q", key)
+			}
+			retryAfter, err := time.ParseDuration(v)
+			if err != nil || retryAfter < time.Second {
+				return fmt.Errorf("maintenance_page retry_after must be a duration of a second or more, got %q", v)
+			}
+			pages.RetryAfter = retryAfter
+		}
+	}
+	return nil
+}
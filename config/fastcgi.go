@@ -0,0 +1,49 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// DefaultFastCGISplitPath splits /index.php/some/path into the script and
+// the PATH_INFO.
+var DefaultFastCGISplitPath = regexp.MustCompile(`^(.+?\.php)(/.*)?$`)
+
+var paramName = regexp.MustCompile(`^[A-Z][A-Z0-9_]*$`)
+
+// FastCGI configures how the requests to fastcgi:// backends are mapped to
+// scripts, like nginx `fastcgi_split_path_info` and `index`.
+type FastCGI struct {
+	Root      string         //document root, the domain's root when empty
+	Index     string         //script of directories and of paths that are not scripts
+	SplitPath *regexp.Regexp //first group is the script, second the PATH_INFO
+	Params    map[string]string
+}
+
+func parseFastCGI(value string) (*FastCGI, error) {
+	fastCGI := &FastCGI{Index: "index.php", SplitPath: DefaultFastCGISplitPath, Params: map[string]string{}}
+	for key, v := range Options(value) {
+		switch key {
+		case "root":
+			fastCGI.Root = v
+		case "index":
+			fastCGI.Index = v
+		case "split_path":
+			re, err := regexp.Compile(v)
+			if err != nil {
+				return nil, err
+			}
+			if re.NumSubexp() != 2 {
+				return nil, fmt.Errorf("fastcgi split_path needs two groups, the script and the path info")
+			}
+			fastCGI.SplitPath = re
+		default:
+			if !paramName.MatchString(key) {
+				return nil, fmt.Errorf("unknown fastcgi option %q", key)
+			}
+			//upper case options are passed to the scripts, such as APP_ENV=production
+			fastCGI.Params[key] = v
+		}
+	}
+	return fastCGI, nil
+}
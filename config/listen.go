@@ -0,0 +1,48 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Listen is the address a server listens on: host:port, or unix:/path for a
+// unix socket.
+type Listen struct {
+	Address string
+	Mode    os.FileMode //permissions of the unix socket, 0 to keep those of the umask
+}
+
+// Addr returns the network and address to listen on.
+func (l Listen) Addr() (string, string) {
+	if strings.HasPrefix(l.Address, "unix:") {
+		return "unix", strings.TrimPrefix(l.Address, "unix:")
+	}
+	return "tcp", l.Address
+}
+
+func parseListen(value string) (Listen, error) {
+	address, options := Fields(value)
+	l := Listen{Address: address}
+	network, path := l.Addr()
+	if network == "unix" && path == "" {
+		return l, fmt.Errorf("unix socket needs a path, got %q", address)
+	}
+	for key, v := range options {
+		switch key {
+		case "mode":
+			mode, err := strconv.ParseUint(v, 8, 32)
+			if err != nil || mode > 0777 {
+				return l, fmt.Errorf("mode expects octal permissions such as 0660, got %q", v)
+			}
+			if network != "unix" {
+				return l, fmt.Errorf("mode is only for unix sockets")
+			}
+			l.Mode = os.FileMode(mode)
+		default:
+			return l, fmt.Errorf("unknown listen option %q", key)
+		}
+	}
+	return l, nil
+}
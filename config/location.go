@@ -0,0 +1,109 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Path matches accepted by `location=`.
+const (
+	MatchExact  = "exact"
+	MatchPrefix = "prefix"
+	MatchRegex  = "regex"
+)
+
+// Actions of a location.
+const (
+	ActionStatic   = "static"
+	ActionProxy    = "proxy"
+	ActionRedirect = "redirect"
+	ActionRespond  = "respond"
+)
+
+// Location is a `location=` block of a domain. The locations of a domain are
+// tried in order and the first one matching the request path handles it.
+type Location struct {
+	Match   string
+	Pattern string
+	Regexp  *regexp.Regexp //compiled Pattern of a regex location
+
+	Action      string
+	Root        string //static: directory to serve files from
+	Upstream    string //proxy: pool name, the domain's own pool when empty
+	Code        int    //redirect and respond: status code
+	Target      string //redirect: URL, may use $1 captures of a regex; respond: body
+	StripPrefix bool   //remove the matched part of the path before serving
+
+	Options RouteOptions //unset options are inherited from the domain
+}
+
+func parseLocation(value string) (*Location, error) {
+	fields := strings.Fields(value)
+	if len(fields) != 2 {
+		return nil, fmt.Errorf("location expects `location=exact|prefix|regex pattern`")
+	}
+	location := &Location{Match: fields[0], Pattern: fields[1]}
+	switch location.Match {
+	case MatchExact, MatchPrefix:
+		if !strings.HasPrefix(location.Pattern, "/") {
+			return nil, fmt.Errorf("location pattern must start with /, got %q", location.Pattern)
+		}
+	case MatchRegex:
+		re, err := regexp.Compile(location.Pattern)
+		if err != nil {
+			return nil, err
+		}
+		location.Regexp = re
+	default:
+		return nil, fmt.Errorf("unknown location match %q", location.Match)
+	}
+	return location, nil
+}
+
+func (location *Location) action(key, value string) error {
+	if key == "strip_prefix" {
+		on, err := parseSwitch(value)
+		location.StripPrefix = on
+		return err
+	}
+	if location.Action != "" {
+		return fmt.Errorf("location %s already has a %s action", location.Pattern, location.Action)
+	}
+	location.Action = key
+	switch key {
+	case ActionStatic:
+		location.Root = value
+		if location.Root == "" {
+			return fmt.Errorf("static needs a directory")
+		}
+	case ActionProxy:
+		location.Upstream = value
+	case ActionRedirect, ActionRespond:
+		parts := strings.SplitN(value, " ", 2)
+		code, err := strconv.Atoi(parts[0])
+		if err != nil || code < 100 || code > 599 {
+			return fmt.Errorf("%s expects a status code first, got %q", key, parts[0])
+		}
+		location.Code = code
+		if len(parts) == 2 {
+			location.Target = strings.TrimSpace(parts[1])
+		}
+		if key == ActionRedirect && (code < 300 || code > 399 || location.Target == "") {
+			return fmt.Errorf("redirect expects `redirect=3xx URL`")
+		}
+	}
+	return nil
+}
+
+// parseSwitch parses on/off values.
+func parseSwitch(value string) (bool, error) {
+	switch value {
+	case "on", "true", "yes":
+		return true, nil
+	case "off", "false", "no":
+		return false, nil
+	}
+	return false, fmt.Errorf("expected on or off, got %q", value)
+}
@@ -0,0 +1,104 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Host name forms accepted by `canonical_host=`.
+const (
+	CanonicalApex = "apex"
+	CanonicalWWW  = "www"
+)
+
+// Trailing slash policies accepted by `trailing_slash=`.
+const (
+	TrailingSlashAdd    = "add"
+	TrailingSlashRemove = "remove"
+)
+
+// Rewrite is a `rewrite=` rule of a domain. Rules are applied in order to the
+// request path before a location is picked.
+type Rewrite struct {
+	Regexp      *regexp.Regexp
+	Replacement string //may use $1 captures, and a query string
+	Code        int    //redirect status, 0 rewrites the request internally
+}
+
+func parseRewrite(value string) (*Rewrite, error) {
+	fields := strings.Fields(value)
+	if len(fields) < 2 {
+		return nil, fmt.Errorf("rewrite expects `rewrite=regex replacement [code=301]`, got %q", value)
+	}
+	re, err := regexp.Compile(fields[0])
+	if err != nil {
+		return nil, err
+	}
+	rewrite := &Rewrite{Regexp: re, Replacement: fields[1]}
+	for key, v := range options(fields[2:]) {
+		if key != "code" {
+			return nil, fmt.Errorf("unknown rewrite option %q", key)
+		}
+		rewrite.Code, err = strconv.Atoi(v)
+		if err != nil || rewrite.Code < 300 || rewrite.Code > 399 {
+			return nil, fmt.Errorf("rewrite code must be a 3xx status, got %q", v)
+		}
+	}
+	if rewrite.Code == 0 && !strings.HasPrefix(rewrite.Replacement, "/") {
+		return nil, fmt.Errorf("internal rewrite must produce a path, got %q; add code=301 to redirect", rewrite.Replacement)
+	}
+	return rewrite, nil
+}
+
+// rewriteDirective handles the directives that normalise the requests of a
+// domain. They belong to the domain even when written inside a location,
+// because they run before a location is picked.
+func (p *parser) rewriteDirective(key, value string) error {
+	if p.host == nil {
+		return fmt.Errorf("%s must be inside a domain block", key)
+	}
+	switch key {
+	case "rewrite":
+		rewrite, err := parseRewrite(value)
+		if err != nil {
+			return err
+		}
+		p.host.Rewrites = append(p.host.Rewrites, rewrite)
+	case "canonical_host":
+		if value != CanonicalApex && value != CanonicalWWW {
+			return fmt.Errorf("canonical_host must be apex or www, got %q", value)
+		}
+		p.host.CanonicalHost = value
+	case "trailing_slash":
+		if value != TrailingSlashAdd && value != TrailingSlashRemove {
+			return fmt.Errorf("trailing_slash must be add or remove, got %q", value)
+		}
+		p.host.TrailingSlash = value
+	}
+	return nil
+}
+
+// Names returns the host names of the domain: its own, and the www or apex
+// form too when canonical_host redirects one to the other.
+func (h *Host) Names() []string {
+	if h.CanonicalHost == "" {
+		return []string{h.Domain}
+	}
+	apex := strings.TrimPrefix(h.Domain, "www.")
+	return []string{apex, "www." + apex}
+}
+
+// Canonical returns the host name that canonical_host redirects to, or the
+// empty string.
+func (h *Host) Canonical() string {
+	apex := strings.TrimPrefix(h.Domain, "www.")
+	switch h.CanonicalHost {
+	case CanonicalApex:
+		return apex
+	case CanonicalWWW:
+		return "www." + apex
+	}
+	return ""
+}
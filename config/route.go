@@ -0,0 +1,389 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RouteOptions are the settings that a domain block gives to all its
+// requests and that a location can override for its own.
+type RouteOptions struct {
+	Cache     *Cache
+	Compress  *Compress
+	RateLimit *RateLimit
+	Auth      *Auth
+	Split     *Split
+	Mirror    *Mirror
+
+	RequestHeaders  []*HeaderRule //sent upstream
+	ResponseHeaders []*HeaderRule //sent to the client
+}
+
+// Inherit fills the settings o leaves unset with the ones of parent.
+func (o RouteOptions) Inherit(parent RouteOptions) RouteOptions {
+	if o.Cache == nil {
+		o.Cache = parent.Cache
+	}
+	if o.Compress == nil {
+		o.Compress = parent.Compress
+	}
+	if o.RateLimit == nil {
+		o.RateLimit = parent.RateLimit
+	}
+	if o.Auth == nil {
+		o.Auth = parent.Auth
+	}
+	if o.Split == nil {
+		o.Split = parent.Split
+	}
+	if o.Mirror == nil {
+		o.Mirror = parent.Mirror
+	}
+	//header rules add up, the domain's apply first
+	o.RequestHeaders = append(append([]*HeaderRule{}, parent.RequestHeaders...), o.RequestHeaders...)
+	o.ResponseHeaders = append(append([]*HeaderRule{}, parent.ResponseHeaders...), o.ResponseHeaders...)
+	return o
+}
+
+// routeOptions returns the options that route directives apply to: the
+// current location's, or the domain's outside of a location.
+func (p *parser) routeOptions(key string) (*RouteOptions, error) {
+	if p.host == nil {
+		return nil, fmt.Errorf("%s must be inside a domain block", key)
+	}
+	if p.location != nil {
+		return &p.location.Options, nil
+	}
+	return &p.host.Options, nil
+}
+
+// Cache configures the HTTP cache of a route.
+type Cache struct {
+	Enabled              bool
+	TTL                  time.Duration //freshness of responses that do not give one
+	Override             bool          //ignore Cache-Control and Expires of responses, always use TTL
+	StaleWhileRevalidate time.Duration //used when responses do not give one
+	StaleIfError         time.Duration //used when responses do not give one
+	MaxObject            int64         //larger responses are not cached
+}
+
+func parseCache(value string) (*Cache, error) {
+	state, options := Fields(value)
+	enabled, err := parseSwitch(state)
+	if err != nil {
+		return nil, err
+	}
+	cache := &Cache{Enabled: enabled, MaxObject: 1 << 20}
+	for key, v := range options {
+		switch key {
+		case "ttl":
+			cache.TTL, err = time.ParseDuration(v)
+		case "override":
+			cache.Override, err = parseSwitch(v)
+		case "stale_while_revalidate":
+			cache.StaleWhileRevalidate, err = time.ParseDuration(v)
+		case "stale_if_error":
+			cache.StaleIfError, err = time.ParseDuration(v)
+		case "max_object":
+			cache.MaxObject, err = ParseSize(v)
+		default:
+			err = fmt.Errorf("unknown cache option %q", key)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if cache.Override && cache.TTL <= 0 {
+		return nil, fmt.Errorf("cache override=on needs a ttl")
+	}
+	return cache, nil
+}
+
+// Cache stores accepted by `cache_store=`.
+const (
+	CacheStoreMemory = "memory"
+	CacheStoreDisk   = "disk"
+	CacheStoreKV     = "kv"
+)
+
+// CacheStore is where the HTTP cache keeps its responses.
+type CacheStore struct {
+	Type string
+	Size int64  //bytes kept before entries are evicted
+	Path string //disk: directory of the cache files
+}
+
+func parseCacheStore(value string) (*CacheStore, error) {
+	storeType, options := Fields(value)
+	store := &CacheStore{Type: storeType, Size: 64 << 20, Path: "cache-http"}
+	switch storeType {
+	case CacheStoreMemory, CacheStoreDisk, CacheStoreKV:
+	default:
+		return nil, fmt.Errorf("unknown cache_store %q, expected memory, disk or kv", storeType)
+	}
+	if storeType == CacheStoreDisk {
+		store.Size = 1 << 30
+	}
+	var err error
+	for key, v := range options {
+		switch key {
+		case "size":
+			store.Size, err = ParseSize(v)
+		case "path":
+			store.Path = v
+		default:
+			err = fmt.Errorf("unknown cache_store option %q", key)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return store, nil
+}
+
+// Compress configures the on-the-fly compression of the responses of a route.
+type Compress struct {
+	Enabled bool
+	Level   int      //1 (fastest) to 9 (smallest)
+	MinSize int64    //smaller responses are sent as they are
+	Types   []string //MIME types to compress, a trailing * matches a prefix
+}
+
+// DefaultCompressTypes are the MIME types compressed when `types=` is not given.
+var DefaultCompressTypes = []string{
+	"text/*",
+	"application/javascript",
+	"application/json",
+	"application/xml",
+	"application/rss+xml",
+	"application/atom+xml",
+	"application/wasm",
+	"image/svg+xml",
+	"font/ttf",
+	"font/otf",
+}
+
+func parseCompress(value string) (*Compress, error) {
+	state, options := Fields(value)
+	enabled, err := parseSwitch(state)
+	if err != nil {
+		return nil, err
+	}
+	compress := &Compress{Enabled: enabled, Level: 6, MinSize: 1 << 10, Types: DefaultCompressTypes}
+	for key, v := range options {
+		switch key {
+		case "level":
+			compress.Level, err = strconv.Atoi(v)
+			if err == nil && (compress.Level < 1 || compress.Level > 9) {
+				err = fmt.Errorf("compress level must be between 1 and 9")
+			}
+		case "min_size":
+			compress.MinSize, err = ParseSize(v)
+		case "types":
+			compress.Types = strings.Split(v, ",")
+		default:
+			err = fmt.Errorf("unknown compress option %q", key)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return compress, nil
+}
+
+// Rate limiting algorithms accepted by `rate_limit=`.
+const (
+	RateLimitTokenBucket   = "token_bucket"
+	RateLimitSlidingWindow = "sliding_window"
+)
+
+// RateLimit configures the request rate limit of a route.
+type RateLimit struct {
+	Enabled   bool
+	Limit     int           //requests per Period
+	Period    time.Duration //second, minute or hour
+	Burst     int           //token bucket capacity
+	Algorithm string
+	Key       string //ip, header, cookie or route
+	KeyName   string //header or cookie name
+	Store     string //memory or kv
+}
+
+func parseRateLimit(value string) (*RateLimit, error) {
+	rate, options := Fields(value)
+	if rate == "off" {
+		return &RateLimit{}, nil
+	}
+	limit := &RateLimit{Enabled: true, Algorithm: RateLimitTokenBucket, Key: "ip", Store: CacheStoreMemory}
+	parts := strings.SplitN(rate, "/", 2)
+	n, err := strconv.Atoi(parts[0])
+	if len(parts) != 2 || err != nil || n < 1 {
+		return nil, fmt.Errorf("rate_limit expects a rate like 10/s, 600/m or 5000/h first, got %q", rate)
+	}
+	limit.Limit = n
+	switch parts[1] {
+	case "s":
+		limit.Period = time.Second
+	case "m":
+		limit.Period = time.Minute
+	case "h":
+		limit.Period = time.Hour
+	default:
+		return nil, fmt.Errorf("rate_limit period must be s, m or h, got %q", parts[1])
+	}
+	limit.Burst = n
+	for key, v := range options {
+		switch key {
+		case "burst":
+			limit.Burst, err = strconv.Atoi(v)
+			if err == nil && limit.Burst < 1 {
+				err = fmt.Errorf("rate_limit burst must be positive")
+			}
+		case "algorithm":
+			limit.Algorithm = v
+			if v != RateLimitTokenBucket && v != RateLimitSlidingWindow {
+				err = fmt.Errorf("unknown rate_limit algorithm %q", v)
+			}
+		case "key":
+			kv := strings.SplitN(v, ":", 2)
+			limit.Key = kv[0]
+			switch {
+			case (kv[0] == "ip" || kv[0] == "route") && len(kv) == 1:
+			case (kv[0] == "header" || kv[0] == "cookie") && len(kv) == 2 && kv[1] != "":
+				limit.KeyName = kv[1]
+			default:
+				err = fmt.Errorf("rate_limit key must be ip, route, header:Name or cookie:name, got %q", v)
+			}
+		case "store":
+			limit.Store = v
+			if v != CacheStoreMemory && v != CacheStoreKV {
+				err = fmt.Errorf("rate_limit store must be memory or kv, got %q", v)
+			}
+		default:
+			err = fmt.Errorf("unknown rate_limit option %q", key)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return limit, nil
+}
+
+// Header operations accepted by `request_header=` and `response_header=`.
+const (
+	HeaderSet    = "set"
+	HeaderAdd    = "add"
+	HeaderRemove = "remove"
+)
+
+// HeaderRule changes one header of a request or response. Value may use
+// the variables $client_ip, $host, $scheme and $request_id.
+type HeaderRule struct {
+	Op    string
+	Name  string
+	Value string
+}
+
+func parseHeaderRule(value string) (*HeaderRule, error) {
+	rule := &HeaderRule{}
+	var rest string
+	rule.Op, rest = firstWord(value) //value stays whole for the errors
+	rule.Name, rule.Value = firstWord(rest)
+	switch {
+	case rule.Op != HeaderSet && rule.Op != HeaderAdd && rule.Op != HeaderRemove:
+		return nil, fmt.Errorf("header rule must start with set, add or remove, got %q", value)
+	case rule.Name == "":
+		return nil, fmt.Errorf("header rule without a header name: %q", value)
+	case rule.Op == HeaderRemove && rule.Value != "":
+		return nil, fmt.Errorf("remove takes only a header name: %q", value)
+	case rule.Op != HeaderRemove && rule.Value == "":
+		return nil, fmt.Errorf("%s needs a header value: %q", rule.Op, value)
+	}
+	return rule, nil
+}
+
+// firstWord splits the first word off a value, the rest keeps its inner spaces.
+func firstWord(value string) (string, string) {
+	value = strings.TrimSpace(value)
+	if i := strings.IndexAny(value, " \t"); i >= 0 {
+		return value[:i], strings.TrimSpace(value[i:])
+	}
+	return value, ""
+}
+
+// Split sends a share of the clients of a proxied route to another pool,
+// such as the canary release of an application.
+type Split struct {
+	Upstream string  //the canary pool, empty when the split is off
+	Percent  float64 //share of the clients, 0 to 100
+	Header   string  //"always" or "never" in this header forces the choice
+	Cookie   string  //"always" or "never" in this cookie forces the choice
+}
+
+func parseSplit(value string) (*Split, error) {
+	fields := strings.Fields(value)
+	if len(fields) == 1 && fields[0] == "off" {
+		return &Split{}, nil
+	}
+	if len(fields) < 2 {
+		return nil, fmt.Errorf("split expects `split=upstream percent`, got %q", value)
+	}
+	percent, err := strconv.ParseFloat(strings.TrimSuffix(fields[1], "%"), 64)
+	if err != nil || percent < 0 || percent > 100 {
+		return nil, fmt.Errorf("split percent must be between 0 and 100, got %q", fields[1])
+	}
+	split := &Split{Upstream: fields[0], Percent: percent}
+	for key, v := range options(fields[2:]) {
+		switch key {
+		case "header":
+			split.Header = v
+		case "cookie":
+			split.Cookie = v
+		default:
+			return nil, fmt.Errorf("unknown split option %q", key)
+		}
+	}
+	return split, nil
+}
+
+// Mirror copies a sample of the requests of a proxied route to a shadow
+// pool, whose responses are thrown away.
+type Mirror struct {
+	Upstream string  //the shadow pool, empty when mirroring is off
+	Sample   float64 //percent of the requests copied
+	MaxBody  int64   //requests with a larger body are not copied
+	Timeout  time.Duration
+}
+
+func parseMirror(value string) (*Mirror, error) {
+	upstream, options := Fields(value)
+	if upstream == "off" {
+		return &Mirror{}, nil
+	}
+	if upstream == "" {
+		return nil, fmt.Errorf("mirror expects an upstream name")
+	}
+	mirror := &Mirror{Upstream: upstream, Sample: 100, MaxBody: 1 << 20, Timeout: 10 * time.Second}
+	var err error
+	for key, v := range options {
+		switch key {
+		case "sample":
+			mirror.Sample, err = strconv.ParseFloat(strings.TrimSuffix(v, "%"), 64)
+			if err == nil && (mirror.Sample < 0 || mirror.Sample > 100) {
+				err = fmt.Errorf("mirror sample must be between 0 and 100")
+			}
+		case "max_body":
+			mirror.MaxBody, err = ParseSize(v)
+		case "timeout":
+			mirror.Timeout, err = time.ParseDuration(v)
+		default:
+			err = fmt.Errorf("unknown mirror option %q", key)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return mirror, nil
+}
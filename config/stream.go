@@ -0,0 +1,123 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// Stream is a raw TCP or UDP listener that forwards connections to pools.
+// The `stream=` lines with the same protocol and address share one.
+type Stream struct {
+	Protocol string //tcp or udp
+	Address  string
+	Timeout  time.Duration //idle time after which a connection or UDP session is closed
+	Routes   []*StreamRoute
+}
+
+// StreamRoute sends the connections of a stream to a pool: the TLS ones
+// asking for SNI, or all the others when SNI is empty.
+type StreamRoute struct {
+	SNI      string //server name, *.example.com matches one more label
+	Upstream string
+	Cert     string //terminate TLS with this certificate, empty to pass it through
+	Key      string
+}
+
+// SharesHTTPS reports whether the stream listens on the HTTPS port. Its SNI
+// routes then take their connections from the HTTPS listener.
+func (st *Stream) SharesHTTPS() bool {
+	_, port, err := net.SplitHostPort(st.Address)
+	return err == nil && st.Protocol == "tcp" && (port == "443" || port == "https")
+}
+
+// streamDirective parses `stream=tcp|udp address upstream=pool [sni=name]
+// [cert= key=] [timeout=]` and adds the route to the stream of the address.
+func (p *parser) streamDirective(value string) error {
+	fields := strings.Fields(value)
+	if len(fields) < 2 || (fields[0] != "tcp" && fields[0] != "udp") {
+		return fmt.Errorf("stream expects tcp or udp and an address, got %q", value)
+	}
+	if _, _, err := net.SplitHostPort(fields[1]); err != nil {
+		return fmt.Errorf("stream address: %v", err)
+	}
+	var st *Stream
+	for _, existing := range p.cfg.Streams {
+		if existing.Protocol == fields[0] && existing.Address == fields[1] {
+			st = existing
+		}
+	}
+	if st == nil {
+		st = &Stream{Protocol: fields[0], Address: fields[1], Timeout: 10 * time.Minute}
+		if st.Protocol == "udp" {
+			st.Timeout = 30 * time.Second
+		}
+		p.cfg.Streams = append(p.cfg.Streams, st)
+	}
+	rt := &StreamRoute{}
+	var err error
+	for key, v := range options(fields[2:]) {
+		switch key {
+		case "upstream":
+			rt.Upstream = v
+		case "sni":
+			rt.SNI = strings.ToLower(v)
+		case "cert":
+			rt.Cert = v
+		case "key":
+			rt.Key = v
+		case "timeout":
+			st.Timeout, err = time.ParseDuration(v)
+			if err == nil && st.Timeout <= 0 {
+				err = fmt.Errorf("stream timeout must be positive")
+			}
+		default:
+			err = fmt.Errorf("unknown stream option %q", key)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	switch {
+	case rt.Upstream == "":
+		return fmt.Errorf("stream needs upstream=")
+	case (rt.Cert == "") != (rt.Key == ""):
+		return fmt.Errorf("stream cert and key go together")
+	case st.Protocol == "udp" && (rt.SNI != "" || rt.Cert != ""):
+		return fmt.Errorf("udp streams have no TLS, sni and cert are for tcp")
+	case strings.Contains(strings.TrimPrefix(rt.SNI, "*."), "*"):
+		return fmt.Errorf("stream sni wildcards are *.domain, got %q", rt.SNI)
+	}
+	for _, existing := range st.Routes {
+		if existing.SNI == rt.SNI {
+			if rt.SNI == "" {
+				return fmt.Errorf("stream %s %s has two routes without sni", st.Protocol, st.Address)
+			}
+			return fmt.Errorf("stream %s %s routes sni %s twice", st.Protocol, st.Address, rt.SNI)
+		}
+	}
+	st.Routes = append(st.Routes, rt)
+	return nil
+}
+
+func (cfg *Config) validateStreams() error {
+	for _, st := range cfg.Streams {
+		for _, rt := range st.Routes {
+			upstream := cfg.Upstreams[rt.Upstream]
+			if upstream == nil {
+				return fmt.Errorf("stream %s %s: unknown upstream %q", st.Protocol, st.Address, rt.Upstream)
+			}
+			if rt.SNI == "" && st.SharesHTTPS() && len(cfg.Hosts) > 0 {
+				//ShareTLS hands the connections no SNI route takes to the HTTPS server
+				return fmt.Errorf("stream %s %s: upstream %s needs sni=, the connections without a matching server name go to the HTTPS server of the domains", st.Protocol, st.Address, rt.Upstream)
+			}
+			for _, backend := range upstream.Backends {
+				if backend.Scheme != "http" || (st.Protocol == "udp" && strings.HasPrefix(backend.Address, "unix:")) {
+					return fmt.Errorf("stream %s %s: upstream %s needs plain host:port backends", st.Protocol, st.Address, rt.Upstream)
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,267 @@
+// Package fastcgi is a client of the FastCGI protocol, enough to send HTTP
+// requests to a responder such as PHP-FPM.
+package fastcgi
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Record types of the protocol.
+const (
+	typeBeginRequest = 1
+	typeAbortRequest = 2
+	typeEndRequest   = 3
+	typeParams       = 4
+	typeStdin        = 5
+	typeStdout       = 6
+	typeStderr       = 7
+)
+
+const (
+	version1      = 1
+	roleResponder = 1
+	requestID     = 1 //one request per connection
+	maxContent    = 65535
+)
+
+// ErrProtocol is returned when the responder sends something that is not
+// FastCGI.
+var ErrProtocol = errors.New("fastcgi: protocol error")
+
+// Do sends a request with params and the stdin body over conn, and returns
+// the CGI response of the responder. The body of the response reads from
+// conn, and closing it closes conn. What the responder writes to stderr is
+// copied to stderr, which may be nil.
+func Do(ctx context.Context, conn net.Conn, params map[string]string, stdin io.Reader, stderr io.Writer) (*http.Response, error) {
+	done := make(chan struct{})
+	go func() {
+		//unblock the reads and writes when the request is canceled
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+	stop := func() { closeOnce(done) }
+
+	w := bufio.NewWriter(conn)
+	err := writeRecord(w, typeBeginRequest, []byte{0, roleResponder, 0, 0, 0, 0, 0, 0})
+	if err == nil {
+		err = writeStream(w, typeParams, bytes.NewReader(encodeParams(params)))
+	}
+	if err == nil {
+		if stdin == nil {
+			stdin = bytes.NewReader(nil)
+		}
+		err = writeStream(w, typeStdin, stdin)
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		stop()
+		conn.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+
+	body := &stdoutReader{conn: conn, r: bufio.NewReader(conn), stderr: stderr, stop: stop}
+	stdout := bufio.NewReader(body)
+	resp, err := readResponse(stdout)
+	if err != nil {
+		body.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	resp.Body = readCloser{stdout, body}
+	return resp, nil
+}
+
+func closeOnce(c chan struct{}) {
+	select {
+	case <-c:
+	default:
+		close(c)
+	}
+}
+
+func writeRecord(w io.Writer, recordType uint8, content []byte) error {
+	padding := (8 - len(content)%8) % 8
+	header := [8]byte{version1, recordType, 0, requestID, 0, 0, uint8(padding), 0}
+	binary.BigEndian.PutUint16(header[4:6], uint16(len(content)))
+	if _, err := w.Write(header[:]); err != nil {
+		return err
+	}
+	if _, err := w.Write(content); err != nil {
+		return err
+	}
+	_, err := w.Write(make([]byte, padding))
+	return err
+}
+
+// writeStream sends r as records of one type, ended by an empty record.
+func writeStream(w io.Writer, recordType uint8, r io.Reader) error {
+	buf := make([]byte, maxContent)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			if werr := writeRecord(w, recordType, buf[:n]); werr != nil {
+				return werr
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return writeRecord(w, recordType, nil)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// encodeParams encodes name-value pairs, lengths under 128 in one byte and
+// others in four.
+func encodeParams(params map[string]string) []byte {
+	var b bytes.Buffer
+	writeLength := func(n int) {
+		if n < 128 {
+			b.WriteByte(byte(n))
+			return
+		}
+		var length [4]byte
+		binary.BigEndian.PutUint32(length[:], uint32(n)|1<<31)
+		b.Write(length[:])
+	}
+	for name, value := range params {
+		writeLength(len(name))
+		writeLength(len(value))
+		b.WriteString(name)
+		b.WriteString(value)
+	}
+	return b.Bytes()
+}
+
+// stdoutReader reads the stdout stream of the response, copying stderr
+// aside, until the end of the request.
+type stdoutReader struct {
+	conn   net.Conn
+	r      *bufio.Reader
+	stderr io.Writer
+	stop   func()
+
+	left    int //content left in the current stdout record
+	padding int
+	ended   bool
+	once    sync.Once
+}
+
+func (s *stdoutReader) Read(p []byte) (int, error) {
+	for s.left == 0 {
+		if s.ended {
+			return 0, io.EOF
+		}
+		if _, err := s.r.Discard(s.padding); err != nil {
+			return 0, err
+		}
+		var header [8]byte
+		if _, err := io.ReadFull(s.r, header[:]); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		if header[0] != version1 {
+			return 0, ErrProtocol
+		}
+		length := int(binary.BigEndian.Uint16(header[4:6]))
+		s.padding = int(header[6])
+		switch header[1] {
+		case typeStdout:
+			s.left = length
+		case typeStderr:
+			stderr := s.stderr
+			if stderr == nil {
+				stderr = ioutil.Discard
+			}
+			if _, err := io.CopyN(stderr, s.r, int64(length)); err != nil {
+				return 0, err
+			}
+		case typeEndRequest:
+			if _, err := s.r.Discard(length); err != nil {
+				return 0, err
+			}
+			s.ended = true
+		default:
+			return 0, fmt.Errorf("%w: unexpected record type %d", ErrProtocol, header[1])
+		}
+	}
+	if len(p) > s.left {
+		p = p[:s.left]
+	}
+	n, err := s.r.Read(p)
+	s.left -= n
+	return n, err
+}
+
+func (s *stdoutReader) Close() error {
+	var err error
+	s.once.Do(func() {
+		s.stop()
+		err = s.conn.Close()
+	})
+	return err
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// readResponse parses the header of a CGI response, leaving r at the start
+// of the body. A Status header gives the status, a Location alone makes it
+// a redirect.
+func readResponse(r *bufio.Reader) (*http.Response, error) {
+	header, err := textproto.NewReader(r).ReadMIMEHeader()
+	if err != nil && !(err == io.EOF && len(header) > 0) {
+		return nil, fmt.Errorf("fastcgi: reading response headers: %v", err)
+	}
+	resp := &http.Response{
+		StatusCode:    http.StatusOK,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header(header),
+		ContentLength: -1,
+	}
+	if status := resp.Header.Get("Status"); status != "" {
+		code, err := strconv.Atoi(strings.SplitN(status, " ", 2)[0])
+		if err != nil || code < 100 || code > 999 {
+			return nil, fmt.Errorf("%w: bad Status header %q", ErrProtocol, status)
+		}
+		resp.StatusCode = code
+		resp.Header.Del("Status")
+	} else if resp.Header.Get("Location") != "" {
+		resp.StatusCode = http.StatusFound
+	}
+	resp.Status = strconv.Itoa(resp.StatusCode) + " " + http.StatusText(resp.StatusCode)
+	if length, err := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64); err == nil {
+		resp.ContentLength = length
+	}
+	return resp, nil
+}
@@ -0,0 +1,69 @@
+package fastcgi
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/fcgi"
+	"strings"
+	"testing"
+)
+
+func TestDo(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go fcgi.Serve(ln, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		env := fcgi.ProcessEnv(r)
+		if r.URL.Path == "/moved" {
+			http.Redirect(w, r, "/new", http.StatusMovedPermanently)
+			return
+		}
+		w.Header().Set("X-Script", env["SCRIPT_FILENAME"])
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(r.Method + " " + string(body) + " " + strings.Repeat("x", 70000)))
+	}))
+
+	do := func(uri, body string) *http.Response {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		params := map[string]string{
+			"REQUEST_METHOD":  "POST",
+			"REQUEST_URI":     uri,
+			"SCRIPT_FILENAME": "/var/www/index.php",
+			"SERVER_PROTOCOL": "HTTP/1.1",
+			"CONTENT_LENGTH":  "5",
+			"LONG_VALUE":      strings.Repeat("v", 300),
+		}
+		resp, err := Do(context.Background(), conn, params, strings.NewReader(body), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	resp := do("/index.php", "hello")
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusCreated || resp.Header.Get("X-Script") != "/var/www/index.php" {
+		t.Fatalf("unexpected response %d %v", resp.StatusCode, resp.Header)
+	}
+	if !strings.HasPrefix(string(body), "POST hello ") || len(body) != len("POST hello ")+70000 {
+		t.Fatalf("body spanning several records came back wrong, %d bytes", len(body))
+	}
+
+	resp = do("/moved", "hello")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMovedPermanently || resp.Header.Get("Location") != "/new" {
+		t.Fatalf("expected a redirect, got %d %v", resp.StatusCode, resp.Header)
+	}
+}
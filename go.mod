@@ -3,8 +3,11 @@ module slashing
 go 1.14
 
 require (
+	github.com/DataDog/zstd v1.5.0
 	github.com/abbychau/jumplist v0.0.0-20210722090223-dc0a454cffc0 // indirect
+	github.com/andybalholm/brotli v1.0.6
 	github.com/mattn/go-sqlite3 v1.14.7
 	github.com/tidwall/redcon v1.4.1
 	golang.org/x/crypto v0.0.0-20210711020723-a769d52b0f97
+	golang.org/x/net v0.0.0-20210226172049-e18ecbb05110
 )
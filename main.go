@@ -1,19 +1,19 @@
 package main
 
 import (
-	"bufio"
 	"context"
 	"crypto/tls"
 	"log"
+	"net"
 	"net/http"
-	"net/http/httputil"
 	"os"
 	"os/signal"
-	"path/filepath"
+	"slashing/config"
+	"slashing/proxy"
+	"slashing/proxyproto"
 	"slashing/rdbms"
 	"slashing/redis"
 	"slashing/utils"
-	"strings"
 	"syscall"
 	"time"
 
@@ -25,42 +25,121 @@ type shutdownFunction func(context.Context) error
 func main() {
 	log.Println("Start slashing...")
 
-	targets, domains, paths, redisAddr, rdbmsAddr := loadConfigurations()
+	cfg := loadConfigurations()
+	redisServer := redis.NewRedisServer(cfg.Redis.Addr())
+	proxyServer, err := proxy.New(cfg, redisServer.Items())
+	if err != nil {
+		log.Fatal(err)
+	}
+	domains := proxyServer.Domains()
 	certManager := autocert.Manager{
 		Prompt:     autocert.AcceptTOS,
 		HostPolicy: autocert.HostWhitelist(domains...),
 		Cache:      autocert.DirCache(utils.CacheDir("cache-autocert")),
 	}
 	shutdowners := []shutdownFunction{}
-	redisServer := redis.NewRedisServer(redisAddr)
+	go func() {
+		//kill -USR1 after logrotate moved the access logs
+		reopen := make(chan os.Signal, 1)
+		signal.Notify(reopen, syscall.SIGUSR1)
+		for range reopen {
+			log.Println("Reopening access logs")
+			proxyServer.ReopenLogs()
+		}
+	}()
 	go func() {
 		log.Println("Starting Redis server...")
 		shutdowners = append(shutdowners, redisServer.Shutdown)
-		log.Fatal(redisServer.ListenAndServe())
+		log.Fatal(redisServer.Serve(listenOn(cfg.Redis, cfg.ProxyProtocol)))
 
 	}()
 	go func() {
 		log.Println("Starting SQL HTTP server...")
-		SQLHTTPServer := rdbms.ListenAndServeHTTPServer(rdbmsAddr)
+		SQLHTTPServer := rdbms.ListenAndServeHTTPServer(cfg.RDBMS.Address)
 		shutdowners = append(shutdowners, SQLHTTPServer.Shutdown)
-		log.Fatal(SQLHTTPServer.ListenAndServe())
+		log.Fatal(SQLHTTPServer.Serve(listenOn(cfg.RDBMS, cfg.ProxyProtocol)))
 	}()
+	if cfg.Admin != "" {
+		go func() {
+			log.Println("Starting admin HTTP server...")
+			adminServer := &http.Server{Addr: cfg.Admin, Handler: proxyServer.AdminHandler()}
+			shutdowners = append(shutdowners, adminServer.Shutdown)
+			log.Fatal(adminServer.ListenAndServe())
+		}()
+	}
+	for _, st := range proxyServer.Streams() {
+		if st.SharesHTTPS() && len(domains) > 0 {
+			continue //its SNI routes take their connections from the HTTPS listener
+		}
+		go func(st *proxy.Stream) {
+			log.Println("Starting", st.Protocol, "stream on", st.Address)
+			if st.Protocol == "udp" {
+				pc, err := net.ListenPacket("udp", st.Address)
+				if err != nil {
+					log.Fatal(err)
+				}
+				log.Fatal(st.ServePacket(pc))
+			}
+			log.Fatal(st.Serve(proxyServer.LimitConns(listen(st.Address, cfg.ProxyProtocol))))
+		}(st)
+	}
+	shutdowners = append(shutdowners, proxyServer.Shutdown)
 	if len(domains) > 0 {
 		go func() {
 			log.Println("Starting HTTP->HTTPS redirector and HTTPS server...")
 			//Not notifying shutdown is not harmful
-			log.Fatal(http.ListenAndServe(":http", certManager.HTTPHandler(nil)))
+			log.Fatal(http.Serve(proxyServer.LimitConns(listen(":http", cfg.ProxyProtocol)), certManager.HTTPHandler(nil)))
 		}()
-		TLSServer := getTLSServer(targets, domains, paths, &certManager)
+		TLSServer := getTLSServer(proxyServer, &certManager)
 		go func() {
 			log.Println("Starting HTTPS server...")
-			log.Fatal(TLSServer.ListenAndServeTLS("", ""))
+			log.Fatal(TLSServer.ServeTLS(proxyServer.ShareTLS(proxyServer.LimitConns(listen(TLSServer.Addr, cfg.ProxyProtocol))), "", ""))
 			shutdowners = append(shutdowners, TLSServer.Shutdown)
 		}()
 	}
 	gracefulBlocker(shutdowners)
 }
 
+// listen opens a TCP listener that reads the PROXY protocol header of the
+// connections coming from the trusted networks.
+func listen(addr string, trusted []*net.IPNet) net.Listener {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(trusted) == 0 {
+		return ln
+	}
+	return &proxyproto.Listener{Listener: ln, Trusted: trusted}
+}
+
+// listenOn opens the listener of a configured address. A unix socket gets
+// the configured permissions; its peers cannot send PROXY protocol headers.
+func listenOn(l config.Listen, trusted []*net.IPNet) net.Listener {
+	network, address := l.Addr()
+	if network != "unix" {
+		return listen(address, trusted)
+	}
+	if info, err := os.Lstat(address); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.Dial("unix", address); err == nil {
+			conn.Close()
+			log.Fatalf("%s is in use by another process", address)
+		}
+		//left behind by a process that did not shut down
+		os.Remove(address)
+	}
+	ln, err := net.Listen("unix", address)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if l.Mode != 0 {
+		if err := os.Chmod(address, l.Mode); err != nil {
+			log.Fatal(err)
+		}
+	}
+	return ln
+}
+
 func gracefulBlocker(shutdowners []shutdownFunction) {
 	quit := make(chan os.Signal, 1)
 	// kill (no param) default send syscall.SIGTERM
@@ -81,8 +160,8 @@ func gracefulBlocker(shutdowners []shutdownFunction) {
 	log.Println("Server exiting")
 }
 
-//loadConfigurations() returns targets, domains, paths, redis-port, rdbms-port
-func loadConfigurations() ([]string, []string, map[string]string, string, string) {
+// loadConfigurations() reads the config file named on the command line
+func loadConfigurations() *config.Config {
 	//Configurations
 	configFileName := ""
 	if len(os.Args) == 2 && utils.FileExists(os.Args[1]) {
@@ -91,44 +170,21 @@ func loadConfigurations() ([]string, []string, map[string]string, string, string
 		log.Println("Error: Config file does not exist. \nUsage: ./slashing config.txt")
 		os.Exit(1)
 	}
-	file, err := os.Open(configFileName)
+	cfg, err := config.Load(configFileName)
 	if err != nil {
 		log.Fatal(err)
 	}
-
-	scanner := bufio.NewScanner(file)
-	domains := []string{}
-	paths := map[string]string{}
-	targets := []string{}
-	var redis string
-	var rdbms string
-	for scanner.Scan() {
-		line := strings.Trim(scanner.Text(), " \t\r\n")
-		if line == "" || string(line[0]) == "#" {
-			continue
-		}
-		parts := strings.Split(line, "=")
-		switch parts[0] {
-		case "backend":
-			targets = append(targets, parts[1])
-		case "redis":
-			redis = parts[1]
-		case "rdbms":
-			rdbms = parts[1]
-		case "domain":
-			valueParts := strings.Split(parts[1], ":")
-			domains = append(domains, valueParts[0])
-			paths[valueParts[0]] = valueParts[1]
-		}
-
+	for _, warning := range cfg.Warnings {
+		log.Println("Config:", warning)
 	}
-	return targets, domains, paths, redis, rdbms
+	return cfg
 }
 
-func getTLSServer(targets []string, domains []string, paths map[string]string, certManager *autocert.Manager) *http.Server {
+func getTLSServer(handler http.Handler, certManager *autocert.Manager) *http.Server {
 
 	server := &http.Server{
-		Addr: ":https",
+		Addr:    ":https",
+		Handler: handler,
 		TLSConfig: &tls.Config{
 			GetCertificate:           certManager.GetCertificate, //Cert generation
 			PreferServerCipherSuites: true,
@@ -144,41 +200,5 @@ func getTLSServer(targets []string, domains []string, paths map[string]string, c
 		},
 	}
 
-	// PROXY ROUTE
-	targetID := 0
-
-	director := func(req *http.Request) {
-		// req.Header.Add("X-Forwarded-Host", req.Host)
-		// req.Header.Add("X-Origin-Host", origin.Host)
-		// req.Header.Add("X-Forwarded-For", req.Header.Get("X-Forwarded-For") ) // Forward Real IP?
-		if targetID == len(targets) {
-			targetID = 0
-		}
-		req.URL.Scheme = "http"
-		req.URL.Host = targets[targetID]
-		targetID++
-	}
-	proxy := &httputil.ReverseProxy{Director: director}
-
-	// HTTP HANDLERS
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		log.Println("Incoming HTTP:", r.Host, r.URL.Path)
-
-		possibleStaticFile := filepath.Join(paths[r.Host], r.URL.Path)
-		log.Println(possibleStaticFile)
-		if utils.FileExists(possibleStaticFile) {
-			//File Exists
-			http.ServeFile(w, r, possibleStaticFile)
-
-		} else {
-			//File not Exist
-			//Do proxying
-			// w.Header().Set("Strict-Transport-Security", "max-age=15768000 ; includeSubDomains")
-			proxy.ServeHTTP(w, r)
-		}
-
-	})
-	// http.Handle("/public/", http.StripPrefix("/public/", http.FileServer(http.Dir("static"))))
-
 	return server
 }
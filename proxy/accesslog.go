@@ -0,0 +1,337 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"slashing/cache"
+	"slashing/config"
+)
+
+// accessLog writes one line per request of a host.
+type accessLog struct {
+	file *logFile
+	json bool
+}
+
+// accessLogOff is the access log of `access_log=off`: requests are not
+// logged at all, not even to the process log.
+var accessLogOff = &accessLog{}
+
+// rotatedSuffix follows the name of a log in the names rotate gives it.
+var rotatedSuffix = regexp.MustCompile(`^\.\d{8}-\d{6}(-\d+)?$`)
+
+// logEntry is what the handlers deeper in the chain tell the access log
+// about a request.
+type logEntry struct {
+	upstream        string //address of the backend that answered, empty if none
+	upstreamLatency time.Duration
+}
+
+// setUpstream records the backend that answered r and how long it took to
+// send its response headers.
+func setUpstream(r *http.Request, backend *Backend, latency time.Duration) {
+	if entry, ok := r.Context().Value(logEntryKey).(*logEntry); ok {
+		entry.upstream, entry.upstreamLatency = backend.Address, latency
+	}
+}
+
+// newAccessLog returns the access log of rules, sharing the file with the
+// other hosts that log to the same path. It returns nil when rules is nil,
+// accessLogOff when logging is off.
+func (s *Server) newAccessLog(rules *config.AccessLog) (*accessLog, error) {
+	if rules == nil {
+		return nil, nil
+	}
+	if rules.Path == "" {
+		return accessLogOff, nil
+	}
+	file, ok := s.logFiles[rules.Path]
+	if !ok {
+		file = &logFile{path: rules.Path, rules: rules}
+		if err := file.open(); err != nil {
+			return nil, fmt.Errorf("access_log: %v", err)
+		}
+		s.logFiles[rules.Path] = file
+	}
+	return &accessLog{file: file, json: rules.Format == config.AccessLogJSON}, nil
+}
+
+// ReopenLogs reopens the access log files, after logrotate moved them.
+func (s *Server) ReopenLogs() {
+	for _, file := range s.logFiles {
+		file.mu.Lock()
+		file.file.Close()
+		if err := file.open(); err != nil {
+			log.Println("Access log:", err)
+		}
+		file.mu.Unlock()
+	}
+}
+
+// accessLogEntry is a line of a JSON access log.
+type accessLogEntry struct {
+	Time            string  `json:"time"`
+	RemoteAddr      string  `json:"remote_addr"`
+	User            string  `json:"user,omitempty"`
+	Host            string  `json:"host"`
+	Method          string  `json:"method"`
+	URI             string  `json:"uri"`
+	Protocol        string  `json:"protocol"`
+	Status          int     `json:"status"`
+	Bytes           int64   `json:"bytes"`
+	Duration        float64 `json:"duration"`
+	Referer         string  `json:"referer,omitempty"`
+	UserAgent       string  `json:"user_agent,omitempty"`
+	Upstream        string  `json:"upstream,omitempty"`
+	UpstreamLatency float64 `json:"upstream_latency,omitempty"`
+	RequestID       string  `json:"request_id"`
+}
+
+// write logs a request, as the client sent it, once its response is done.
+func (l *accessLog) write(r *http.Request, sw *statusWriter, entry *logEntry, start time.Time) {
+	status := sw.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	user, _, _ := r.BasicAuth()
+	duration := time.Since(start)
+	var line []byte
+	if l.json {
+		e := accessLogEntry{
+			Time:       start.Format("2006-01-02T15:04:05.000Z07:00"),
+			RemoteAddr: clientIP(r),
+			User:       user,
+			Host:       r.Host,
+			Method:     r.Method,
+			URI:        r.RequestURI,
+			Protocol:   r.Proto,
+			Status:     status,
+			Bytes:      sw.bytes,
+			Duration:   duration.Seconds(),
+			Referer:    r.Referer(),
+			UserAgent:  r.UserAgent(),
+			Upstream:   entry.upstream,
+			RequestID:  requestID(r),
+		}
+		if entry.upstream != "" {
+			e.UpstreamLatency = entry.upstreamLatency.Seconds()
+		}
+		line, _ = json.Marshal(e)
+	} else {
+		//Apache combined, then the duration, the upstream and its latency
+		upstream, upstreamLatency := "-", "-"
+		if entry.upstream != "" {
+			upstream, upstreamLatency = entry.upstream, fmt.Sprintf("%.3f", entry.upstreamLatency.Seconds())
+		}
+		line = []byte(fmt.Sprintf(`%s - %s [%s] "%s %s %s" %d %d "%s" "%s" %.3f %s %s`,
+			clientIP(r), orDash(escapeLog(user)), start.Format("02/Jan/2006:15:04:05 -0700"),
+			escapeLog(r.Method), escapeLog(r.RequestURI), escapeLog(r.Proto), status, sw.bytes,
+			orDash(escapeLog(r.Referer())), orDash(escapeLog(r.UserAgent())),
+			duration.Seconds(), upstream, upstreamLatency))
+	}
+	l.file.write(append(line, '\n'), start)
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// escapeLog keeps what clients send from breaking the fields and lines of
+// a combined log.
+func escapeLog(s string) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		switch {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < 0x20 || c >= 0x7f:
+			fmt.Fprintf(&b, `\x%02x`, c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// logFile is an access log file, rotated by size or time.
+type logFile struct {
+	path  string
+	rules *config.AccessLog
+
+	mu        sync.Mutex
+	file      *os.File //nil when it could not be opened
+	size      int64
+	lastWrite time.Time
+}
+
+func (f *logFile) open() error {
+	f.file = nil
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.size, f.lastWrite = file, info.Size(), info.ModTime()
+	return nil
+}
+
+func (f *logFile) write(line []byte, now time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file != nil && f.size > 0 && f.due(now, int64(len(line))) {
+		if err := f.rotate(now); err != nil {
+			log.Println("Access log: rotating", f.path, err)
+		}
+	}
+	if f.file == nil {
+		return
+	}
+	n, _ := f.file.Write(line)
+	f.size += int64(n)
+	f.lastWrite = now
+}
+
+// due reports whether the file must be rotated before a line is written.
+// Time rotation happens at the first line of a new period; periods start
+// at multiples of Rotate since midnight UTC.
+func (f *logFile) due(now time.Time, length int64) bool {
+	if f.rules.MaxSize > 0 && f.size+length > f.rules.MaxSize {
+		return true
+	}
+	return f.rules.Rotate > 0 && !now.Truncate(f.rules.Rotate).Equal(f.lastWrite.Truncate(f.rules.Rotate))
+}
+
+// rotate renames the file after the current time, starts a new one and
+// deletes the rotated files over Keep.
+func (f *logFile) rotate(now time.Time) error {
+	f.file.Close()
+	rotated := f.path + "." + now.Format("20060102-150405")
+	for i := 1; fileExists(rotated); i++ {
+		rotated = fmt.Sprintf("%s.%s-%d", f.path, now.Format("20060102-150405"), i)
+	}
+	renameErr := os.Rename(f.path, rotated)
+	if err := f.open(); err != nil {
+		return err
+	}
+	if renameErr != nil {
+		return renameErr
+	}
+	if f.rules.Keep == 0 {
+		return nil
+	}
+	dir, base := filepath.Split(f.path)
+	if dir == "" {
+		dir = "."
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	var old []string
+	for _, info := range files {
+		//only the files rotate made, not access.log.bak or another log
+		if strings.HasPrefix(info.Name(), base) && rotatedSuffix.MatchString(info.Name()[len(base):]) && info.Mode().IsRegular() {
+			old = append(old, info.Name())
+		}
+	}
+	//the names sort by the time of their rotation
+	sort.Strings(old)
+	for len(old) > f.rules.Keep {
+		os.Remove(filepath.Join(dir, old[0]))
+		old = old[1:]
+	}
+	return nil
+}
+
+func fileExists(name string) bool {
+	_, err := os.Lstat(name)
+	return err == nil
+}
+
+// statusWriter remembers the status and the body size of a response.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (sw *statusWriter) WriteHeader(status int) {
+	if sw.status == 0 {
+		sw.status = status
+	}
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+func (sw *statusWriter) Write(b []byte) (int, error) {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	n, err := sw.ResponseWriter.Write(b)
+	sw.bytes += int64(n)
+	return n, err
+}
+
+func (sw *statusWriter) Flush() {
+	if flusher, ok := sw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack lets upgraded connections, such as WebSockets, through.
+func (sw *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if sw.status == 0 {
+		sw.status = http.StatusSwitchingProtocols
+	}
+	return hijack(sw.ResponseWriter)
+}
+
+// hijack takes over the connection of w, for the writers wrapping the
+// response of an upgrade.
+func hijack(w http.ResponseWriter) (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("connection cannot be hijacked")
+	}
+	return hijacker.Hijack()
+}
+
+// ownLogEntry gives the background revalidations of the cache a log entry of
+// their own: the line of the request that triggered them may be written
+// already.
+func ownLogEntry(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if cache.Background(r) {
+			r, _ = withLogEntry(r)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// withLogEntry gives r a log entry for the handlers to fill in.
+func withLogEntry(r *http.Request) (*http.Request, *logEntry) {
+	entry := &logEntry{}
+	return r.WithContext(context.WithValue(r.Context(), logEntryKey, entry)), entry
+}
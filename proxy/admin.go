@@ -0,0 +1,67 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+)
+
+type backendStatus struct {
+	Address string `json:"address"`
+	Healthy bool   `json:"healthy"`
+	Breaker string `json:"circuit_breaker"`
+}
+
+type poolStatus struct {
+	Name     string          `json:"name"`
+	Checked  bool            `json:"health_checked"`
+	Backends []backendStatus `json:"backends"`
+}
+
+// AdminHandler serves the admin API of the proxy:
+//
+//	GET  /upstreams    health state of every backend
+//	POST /cache/purge  drop the cached responses of a URL
+//	POST /cache/ban    invalidate the cached responses matching a pattern
+//	GET  /splits       canary splits of the routes
+//	POST /splits       change the share of a canary pool
+//	GET  /mirrors      counters of the shadow traffic
+func (s *Server) AdminHandler() http.Handler {
+	router := http.NewServeMux()
+	router.HandleFunc("/upstreams", s.handleUpstreams)
+	router.HandleFunc("/cache/purge", s.handleCachePurge)
+	router.HandleFunc("/cache/ban", s.handleCacheBan)
+	router.HandleFunc("/splits", s.handleSplits)
+	router.HandleFunc("/mirrors", s.handleMirrors)
+	return router
+}
+
+func (s *Server) handleUpstreams(w http.ResponseWriter, r *http.Request) {
+	statuses := []poolStatus{}
+	for _, pool := range s.pools {
+		if len(pool.Backends) == 0 {
+			continue
+		}
+		status := poolStatus{Name: pool.Name, Checked: pool.check != nil}
+		for _, backend := range pool.Backends {
+			status.Backends = append(status.Backends, backendStatus{
+				Address: backend.Address,
+				Healthy: backend.Healthy(),
+				Breaker: backend.breaker.status().String(),
+			})
+		}
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	writeJSON(w, statuses)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, "JSON serialization Error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
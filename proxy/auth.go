@@ -0,0 +1,222 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"slashing/config"
+)
+
+// authHandler lets through the requests that pass the authentication of a
+// route. The files it needs are read now, so that mistakes show at startup.
+func (s *Server) authHandler(next http.Handler, rules *config.Auth) (http.Handler, error) {
+	switch rules.Type {
+	case config.AuthBasic:
+		users := &watchedFile{path: rules.File, parse: parseHtpasswd}
+		if _, err := users.load(); err != nil {
+			return nil, err
+		}
+		return basicAuth(next, rules, users), nil
+	case config.AuthJWT:
+		keys := &watchedFile{path: rules.File, parse: parseJWKS}
+		if _, err := keys.load(); err != nil {
+			return nil, err
+		}
+		return jwtAuth(next, rules, keys), nil
+	}
+	return forwardAuth(next, rules), nil
+}
+
+// watchedFile is a configuration file read again when it changes, so that
+// users and keys can be rotated without a restart.
+type watchedFile struct {
+	path  string
+	parse func([]byte) (interface{}, error)
+
+	mu      sync.Mutex
+	checked time.Time //the file is looked at once a second at most
+	modTime time.Time
+	value   interface{}
+}
+
+// load returns the parsed file. When a changed file cannot be read or
+// parsed, the previous content is kept.
+func (f *watchedFile) load() (interface{}, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	now := time.Now()
+	if f.value != nil && now.Sub(f.checked) < time.Second {
+		return f.value, nil
+	}
+	f.checked = now
+	info, err := os.Stat(f.path)
+	if err == nil && f.value != nil && info.ModTime().Equal(f.modTime) {
+		return f.value, nil
+	}
+	var value interface{}
+	if err == nil {
+		var data []byte
+		if data, err = ioutil.ReadFile(f.path); err == nil {
+			value, err = f.parse(data)
+		}
+	}
+	if err != nil {
+		err = fmt.Errorf("auth file %s: %v", f.path, err)
+		if f.value == nil {
+			return nil, err
+		}
+		log.Println(err, "- keeping the previous content")
+		return f.value, nil
+	}
+	f.value, f.modTime = value, info.ModTime()
+	return value, nil
+}
+
+// htpasswd maps user names to bcrypt hashes. The password of an unknown
+// user is checked against dummy, which costs as much as the dearest hash, so
+// that the response time does not tell which users exist.
+type htpasswd struct {
+	users map[string][]byte
+	dummy []byte
+}
+
+func parseHtpasswd(data []byte) (interface{}, error) {
+	users := map[string][]byte{}
+	cost := bcrypt.MinCost
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		parts := strings.SplitN(text, ":", 2)
+		if len(parts) != 2 || !strings.HasPrefix(parts[1], "$2") {
+			return nil, fmt.Errorf("line %d: expected user:bcrypt-hash (htpasswd -B)", line)
+		}
+		users[parts[0]] = []byte(parts[1])
+		if c, err := bcrypt.Cost(users[parts[0]]); err == nil && c > cost {
+			cost = c
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	dummy, err := bcrypt.GenerateFromPassword([]byte("no such user"), cost)
+	if err != nil {
+		return nil, err
+	}
+	return &htpasswd{users: users, dummy: dummy}, nil
+}
+
+func basicAuth(next http.Handler, rules *config.Auth, users *watchedFile) http.Handler {
+	challenge := fmt.Sprintf(`Basic realm=%q, charset="UTF-8"`, rules.Realm)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, ok := r.BasicAuth()
+		if ok {
+			table, _ := users.load()
+			hash, found := table.(*htpasswd).users[user]
+			if !found {
+				hash = table.(*htpasswd).dummy
+			}
+			ok = bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil && found
+		}
+		if !ok {
+			w.Header().Set("WWW-Authenticate", challenge)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func jwtAuth(next http.Handler, rules *config.Auth, keys *watchedFile) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization := r.Header.Get("Authorization")
+		if len(authorization) < 7 || !strings.EqualFold(authorization[:7], "Bearer ") {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		set, _ := keys.load()
+		if err := set.(*jwks).verify(strings.TrimSpace(authorization[7:]), rules, time.Now()); err != nil {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer error="invalid_token", error_description=%q`, err.Error()))
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// hopHeaders are not passed on between connections.
+var hopHeaders = []string{"Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization", "Proxy-Connection", "Te", "Trailer", "Transfer-Encoding", "Upgrade"}
+
+// forwardAuth asks the auth service about every request with a GET
+// carrying the request's headers. A 2xx answer lets the request through
+// with the Copy headers of the answer; any other answer goes back to the
+// client, so that the service can redirect to a login page.
+func forwardAuth(next http.Handler, rules *config.Auth) http.Handler {
+	client := &http.Client{
+		Timeout: rules.Timeout,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, rules.URL, nil)
+		if err != nil {
+			http.Error(w, "Bad auth request", http.StatusInternalServerError)
+			return
+		}
+		req.Header = r.Header.Clone()
+		for _, name := range append(hopHeaders, "Content-Length") {
+			req.Header.Del(name)
+		}
+		proto := "http"
+		if r.TLS != nil {
+			proto = "https"
+		}
+		req.Header.Set("X-Forwarded-Method", r.Method)
+		req.Header.Set("X-Forwarded-Proto", proto)
+		req.Header.Set("X-Forwarded-Host", r.Host)
+		req.Header.Set("X-Forwarded-Uri", r.URL.RequestURI())
+		req.Header.Set("X-Forwarded-For", clientIP(r))
+
+		resp, err := client.Do(req)
+		if err != nil {
+			log.Printf("Forward auth error from %s: %v", rules.URL, err)
+			http.Error(w, "Authentication service unavailable", http.StatusBadGateway)
+			return
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			for name, values := range resp.Header {
+				w.Header()[name] = values
+			}
+			for _, name := range hopHeaders {
+				w.Header().Del(name)
+			}
+			w.WriteHeader(resp.StatusCode)
+			io.Copy(w, resp.Body)
+			return
+		}
+		for _, name := range rules.Copy {
+			//the client must not be able to set these itself
+			r.Header.Del(name)
+			for _, value := range resp.Header.Values(name) {
+				r.Header.Add(name, value)
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
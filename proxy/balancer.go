@@ -0,0 +1,169 @@
+package proxy
+
+import (
+	"hash/crc32"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"slashing/config"
+)
+
+// Balancer chooses the backend of a pool that serves a request. usable
+// reports whether a backend may currently take traffic; a balancer returns
+// nil when no usable backend is left.
+type Balancer interface {
+	Pick(r *http.Request, backends []*Backend, usable func(*Backend) bool) *Backend
+}
+
+func newBalancer(balance config.Balance, backends []*Backend) Balancer {
+	switch balance.Method {
+	case config.BalanceRoundRobin:
+		return &roundRobin{}
+	case config.BalanceWeightedRoundRobin:
+		return &weightedRoundRobin{current: make([]int, len(backends))}
+	case config.BalanceLeastConn:
+		return leastConn{}
+	case config.BalanceIPHash:
+		return ipHash{}
+	case config.BalanceHash:
+		return newConsistentHash(balance.Header, balance.Cookie, backends)
+	}
+	for _, b := range backends {
+		if b.Weight != 1 {
+			return &weightedRoundRobin{current: make([]int, len(backends))}
+		}
+	}
+	return &roundRobin{}
+}
+
+// firstUsable walks the backends from start and returns the first usable one.
+func firstUsable(backends []*Backend, start uint32, usable func(*Backend) bool) *Backend {
+	for i := 0; i < len(backends); i++ {
+		backend := backends[int((start+uint32(i))%uint32(len(backends)))]
+		if usable(backend) {
+			return backend
+		}
+	}
+	return nil
+}
+
+type roundRobin struct {
+	next uint32
+}
+
+func (rr *roundRobin) Pick(r *http.Request, backends []*Backend, usable func(*Backend) bool) *Backend {
+	return firstUsable(backends, atomic.AddUint32(&rr.next, 1)-1, usable)
+}
+
+// weightedRoundRobin is nginx's smooth weighted round-robin: every pick adds
+// each backend's weight to its current weight, takes the largest and
+// subtracts the total from it.
+type weightedRoundRobin struct {
+	sync.Mutex
+	current []int
+}
+
+func (wrr *weightedRoundRobin) Pick(r *http.Request, backends []*Backend, usable func(*Backend) bool) *Backend {
+	wrr.Lock()
+	defer wrr.Unlock()
+	best, total := -1, 0
+	for i, backend := range backends {
+		if !usable(backend) {
+			continue
+		}
+		wrr.current[i] += backend.Weight
+		total += backend.Weight
+		if best == -1 || wrr.current[i] > wrr.current[best] {
+			best = i
+		}
+	}
+	if best == -1 {
+		return nil
+	}
+	wrr.current[best] -= total
+	return backends[best]
+}
+
+// leastConn picks the backend with the fewest outstanding requests relative
+// to its weight.
+type leastConn struct{}
+
+func (leastConn) Pick(r *http.Request, backends []*Backend, usable func(*Backend) bool) *Backend {
+	var best *Backend
+	var bestActive int64
+	for _, backend := range backends {
+		if !usable(backend) {
+			continue
+		}
+		active := atomic.LoadInt64(&backend.active)
+		if best == nil || active*int64(best.Weight) < bestActive*int64(backend.Weight) {
+			best, bestActive = backend, active
+		}
+	}
+	return best
+}
+
+// ipHash keeps a client on one backend as long as the pool does not change.
+type ipHash struct{}
+
+func (ipHash) Pick(r *http.Request, backends []*Backend, usable func(*Backend) bool) *Backend {
+	ip := clientIP(r)
+	return firstUsable(backends, crc32.ChecksumIEEE([]byte(ip)), usable)
+}
+
+// consistentHash maps a header or cookie onto a hash ring, so that only the
+// keys of a missing backend move when the pool changes.
+type consistentHash struct {
+	header   string
+	cookie   string
+	ring     []uint32
+	owners   map[uint32]*Backend
+	fallback roundRobin
+}
+
+const ringReplicas = 100
+
+func newConsistentHash(header, cookie string, backends []*Backend) *consistentHash {
+	ch := &consistentHash{header: header, cookie: cookie, owners: map[uint32]*Backend{}}
+	for _, backend := range backends {
+		for i := 0; i < ringReplicas*backend.Weight; i++ {
+			point := crc32.ChecksumIEEE([]byte(strconv.Itoa(i) + "-" + backend.Address))
+			if _, taken := ch.owners[point]; taken {
+				continue
+			}
+			ch.owners[point] = backend
+			ch.ring = append(ch.ring, point)
+		}
+	}
+	sort.Slice(ch.ring, func(i, j int) bool { return ch.ring[i] < ch.ring[j] })
+	return ch
+}
+
+func (ch *consistentHash) key(r *http.Request) string {
+	if ch.header != "" {
+		return r.Header.Get(ch.header)
+	}
+	if cookie, err := r.Cookie(ch.cookie); err == nil {
+		return cookie.Value
+	}
+	return ""
+}
+
+func (ch *consistentHash) Pick(r *http.Request, backends []*Backend, usable func(*Backend) bool) *Backend {
+	key := ch.key(r)
+	if key == "" || len(ch.ring) == 0 {
+		return ch.fallback.Pick(r, backends, usable)
+	}
+	hash := crc32.ChecksumIEEE([]byte(key))
+	start := sort.Search(len(ch.ring), func(i int) bool { return ch.ring[i] >= hash })
+	for i := 0; i < len(ch.ring); i++ {
+		backend := ch.owners[ch.ring[(start+i)%len(ch.ring)]]
+		if usable(backend) {
+			return backend
+		}
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package proxy
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"slashing/config"
+)
+
+func testBackends(weights ...int) []*Backend {
+	backends := []*Backend{}
+	for i, weight := range weights {
+		backends = append(backends, &Backend{Address: string(rune('a'+i)) + ":80", Weight: weight})
+	}
+	return backends
+}
+
+func always(*Backend) bool { return true }
+
+func TestWeightedRoundRobin(t *testing.T) {
+	backends := testBackends(3, 1)
+	balancer := newBalancer(config.Balance{}, backends)
+	counts := map[*Backend]int{}
+	for i := 0; i < 8; i++ {
+		counts[balancer.Pick(httptest.NewRequest("GET", "/", nil), backends, always)]++
+	}
+	if counts[backends[0]] != 6 || counts[backends[1]] != 2 {
+		t.Fatalf("weights 3:1 should give 6:2, got %d:%d", counts[backends[0]], counts[backends[1]])
+	}
+}
+
+func TestLeastConn(t *testing.T) {
+	backends := testBackends(1, 1, 1)
+	backends[0].active, backends[1].active, backends[2].active = 4, 1, 2
+	balancer := newBalancer(config.Balance{Method: config.BalanceLeastConn}, backends)
+	if got := balancer.Pick(httptest.NewRequest("GET", "/", nil), backends, always); got != backends[1] {
+		t.Fatal("expected the backend with the fewest requests, got", got.Address)
+	}
+}
+
+func TestConsistentHash(t *testing.T) {
+	backends := testBackends(1, 1, 1, 1)
+	balancer := newBalancer(config.Balance{Method: config.BalanceHash, Header: "X-User"}, backends)
+	pick := func(user string, usable func(*Backend) bool) *Backend {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("X-User", user)
+		return balancer.Pick(r, backends, usable)
+	}
+	users := []string{"alice", "bob", "carol", "dave", "erin", "frank", "grace", "heidi"}
+	before := map[string]*Backend{}
+	for _, user := range users {
+		before[user] = pick(user, always)
+		if pick(user, always) != before[user] {
+			t.Fatal("same key should go to the same backend")
+		}
+	}
+	without := func(b *Backend) bool { return b != backends[0] }
+	for _, user := range users {
+		after := pick(user, without)
+		if before[user] != backends[0] && after != before[user] {
+			t.Errorf("%s moved from %s to %s although its backend is still up", user, before[user].Address, after.Address)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package proxy
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"slashing/config"
+)
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+// breaker ejects a backend when live traffic to it keeps failing. After the
+// cool-down it lets a few trial requests through (half-open) and restores
+// the backend once they all succeed.
+type breaker struct {
+	sync.Mutex
+	config *config.CircuitBreaker
+	name   string
+
+	state       breakerState
+	failures    int
+	windowStart time.Time
+	openedAt    time.Time
+	trials      int //trial requests handed out while half-open
+	successes   int //trial requests that succeeded
+}
+
+func newBreaker(cfg *config.CircuitBreaker, name string) *breaker {
+	if cfg == nil {
+		return nil
+	}
+	return &breaker{config: cfg, name: name}
+}
+
+// allow reports whether a request may go to the backend. While half-open it
+// hands out at most HalfOpen trial requests.
+func (b *breaker) allow() bool {
+	if b == nil {
+		return true
+	}
+	b.Lock()
+	defer b.Unlock()
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < b.config.Cooldown {
+			return false
+		}
+		b.state = breakerHalfOpen
+		b.trials, b.successes = 0, 0
+		log.Printf("Circuit breaker: %s is half-open", b.name)
+		fallthrough
+	case breakerHalfOpen:
+		if b.trials >= b.config.HalfOpen {
+			return false
+		}
+		b.trials++
+	}
+	return true
+}
+
+// ready reports whether allow would let a request through, without taking
+// a trial request.
+func (b *breaker) ready() bool {
+	if b == nil {
+		return true
+	}
+	b.Lock()
+	defer b.Unlock()
+	switch b.state {
+	case breakerOpen:
+		return time.Since(b.openedAt) >= b.config.Cooldown
+	case breakerHalfOpen:
+		return b.trials < b.config.HalfOpen
+	}
+	return true
+}
+
+// report records the outcome of a request that allow let through.
+func (b *breaker) report(ok bool) {
+	if b == nil {
+		return
+	}
+	b.Lock()
+	defer b.Unlock()
+	now := time.Now()
+	switch b.state {
+	case breakerClosed:
+		if ok {
+			return
+		}
+		if now.Sub(b.windowStart) > b.config.Window {
+			b.windowStart, b.failures = now, 0
+		}
+		b.failures++
+		if b.failures >= b.config.MaxFails {
+			b.open(now)
+		}
+	case breakerHalfOpen:
+		if !ok {
+			b.open(now)
+			return
+		}
+		b.successes++
+		if b.successes >= b.config.HalfOpen {
+			b.state, b.failures = breakerClosed, 0
+			log.Printf("Circuit breaker: %s is closed again", b.name)
+		}
+	}
+}
+
+// release gives back a trial request whose outcome says nothing about the
+// backend, e.g. because the client went away.
+func (b *breaker) release() {
+	if b == nil {
+		return
+	}
+	b.Lock()
+	defer b.Unlock()
+	if b.state == breakerHalfOpen && b.trials > 0 {
+		b.trials--
+	}
+}
+
+func (b *breaker) open(now time.Time) {
+	b.state, b.openedAt = breakerOpen, now
+	log.Printf("Circuit breaker: %s is open for %v after %d failures", b.name, b.config.Cooldown, b.failures)
+}
+
+func (b *breaker) status() breakerState {
+	if b == nil {
+		return breakerClosed
+	}
+	b.Lock()
+	defer b.Unlock()
+	return b.state
+}
@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"log"
+	"net/http"
+
+	"slashing/cache"
+	"slashing/config"
+	"slashing/redis/hashmap"
+)
+
+// setupCache opens the cache store if any route caches.
+func (s *Server) setupCache(cfg *config.Config, kv *hashmap.HashMap) error {
+	enabled := false
+	for _, h := range cfg.Hosts {
+		if h.Options.Cache != nil && h.Options.Cache.Enabled {
+			enabled = true
+		}
+		for _, location := range h.Locations {
+			if location.Options.Cache != nil && location.Options.Cache.Enabled {
+				enabled = true
+			}
+		}
+	}
+	if !enabled {
+		return nil
+	}
+	storeConfig := cfg.CacheStore
+	if storeConfig == nil {
+		storeConfig = &config.CacheStore{Type: config.CacheStoreMemory, Size: 64 << 20}
+	}
+	var store cache.Store
+	switch storeConfig.Type {
+	case config.CacheStoreMemory:
+		store = cache.NewMemoryStore(storeConfig.Size)
+	case config.CacheStoreDisk:
+		disk, err := cache.NewDiskStore(storeConfig.Path, storeConfig.Size)
+		if err != nil {
+			return err
+		}
+		store = disk
+	case config.CacheStoreKV:
+		if kv == nil {
+			log.Println("Cache: no embedded KV store, caching in memory instead")
+			store = cache.NewMemoryStore(storeConfig.Size)
+			break
+		}
+		store = cache.NewKVStore(kv, "slashing:http-cache:", storeConfig.Size)
+	}
+	s.cache = cache.New(store)
+	return nil
+}
+
+// handleCachePurge drops the cached responses of a URL:
+//
+//	POST /cache/purge?url=https://example.com/page
+func (s *Server) handleCachePurge(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != "PURGE" {
+		http.Error(w, "POST or PURGE only", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.cache == nil {
+		http.Error(w, "No route caches", http.StatusNotFound)
+		return
+	}
+	if err := s.cache.Purge(r.FormValue("url")); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, map[string]string{"purged": r.FormValue("url")})
+}
+
+// handleCacheBan invalidates all cached responses matching a pattern:
+//
+//	POST /cache/ban?host=example.com&pattern=^/blog/
+func (s *Server) handleCacheBan(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != "BAN" {
+		http.Error(w, "POST or BAN only", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.cache == nil {
+		http.Error(w, "No route caches", http.StatusNotFound)
+		return
+	}
+	if err := s.cache.Ban(r.FormValue("host"), r.FormValue("pattern")); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, map[string]string{"banned": r.FormValue("pattern"), "host": r.FormValue("host")})
+}
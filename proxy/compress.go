@@ -0,0 +1,208 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"slashing/config"
+
+	"github.com/DataDog/zstd"
+	"github.com/andybalholm/brotli"
+)
+
+// encoders are the content codings slashing can produce, in order of
+// preference.
+var encoders = []struct {
+	name      string
+	newWriter func(w io.Writer, level int) (io.WriteCloser, error)
+}{
+	{"br", func(w io.Writer, level int) (io.WriteCloser, error) { return brotli.NewWriterLevel(w, level), nil }},
+	{"zstd", func(w io.Writer, level int) (io.WriteCloser, error) { return zstd.NewWriterLevel(w, level), nil }},
+	{"gzip", func(w io.Writer, level int) (io.WriteCloser, error) { return gzip.NewWriterLevel(w, level) }},
+	{"deflate", func(w io.Writer, level int) (io.WriteCloser, error) { return flate.NewWriter(w, level) }},
+}
+
+// negotiateEncoding returns the index in encoders of the preferred coding
+// the client accepts, or -1.
+func negotiateEncoding(acceptEncoding string) int {
+	best, bestQ := -1, 0.0
+	for i, encoder := range encoders {
+		if q := acceptQuality(acceptEncoding, encoder.name); q > bestQ {
+			best, bestQ = i, q
+		}
+	}
+	return best
+}
+
+// compressHandler compresses the responses of next that the client accepts
+// compressed and whose type is listed in rules.
+func compressHandler(next http.Handler, rules *config.Compress) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cw := &compressWriter{
+			ResponseWriter: w,
+			rules:          rules,
+			encoder:        negotiateEncoding(r.Header.Get("Accept-Encoding")),
+			head:           r.Method == http.MethodHead,
+		}
+		defer cw.close()
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// compressible reports whether rules list the type of a response.
+func compressible(rules *config.Compress, contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, pattern := range rules.Types {
+		if pattern == mediaType || (strings.HasSuffix(pattern, "*") && strings.HasPrefix(mediaType, strings.TrimSuffix(pattern, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+// compressWriter holds the first MinSize bytes of a compressible response
+// back, then decides whether it is worth compressing.
+type compressWriter struct {
+	http.ResponseWriter
+	rules   *config.Compress
+	encoder int //index in encoders, -1 if the client accepts none
+	head    bool
+
+	status      int
+	wroteHeader bool //WriteHeader was called on cw
+	decided     bool //the header was sent downstream
+	eligible    bool //the response may be compressed
+	buf         bytes.Buffer
+	writer      io.WriteCloser //compressor, nil when passing through
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	if cw.wroteHeader {
+		return
+	}
+	if status >= 100 && status < 200 && status != http.StatusSwitchingProtocols {
+		//informational, such as 103 Early Hints: the final status is still to come
+		cw.ResponseWriter.WriteHeader(status)
+		return
+	}
+	cw.wroteHeader, cw.status = true, status
+	header := cw.Header()
+	cw.eligible = compressible(cw.rules, header.Get("Content-Type")) &&
+		header.Get("Content-Encoding") == "" &&
+		status != http.StatusNoContent && status != http.StatusNotModified && status != http.StatusPartialContent &&
+		status >= http.StatusOK
+	if cw.eligible {
+		//the response differs by Accept-Encoding whether or not this client gets it compressed
+		addVary(header, "Accept-Encoding")
+	}
+	if !cw.eligible || cw.encoder < 0 || cw.head {
+		cw.send(false)
+		return
+	}
+	if length, err := strconv.ParseInt(header.Get("Content-Length"), 10, 64); err == nil {
+		cw.send(length >= cw.rules.MinSize)
+	}
+}
+
+func (cw *compressWriter) Write(b []byte) (int, error) {
+	if !cw.wroteHeader {
+		if cw.Header().Get("Content-Type") == "" {
+			cw.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		cw.WriteHeader(http.StatusOK)
+	}
+	if !cw.decided {
+		cw.buf.Write(b)
+		if int64(cw.buf.Len()) >= cw.rules.MinSize {
+			cw.send(true)
+		}
+		return len(b), nil
+	}
+	if cw.writer != nil {
+		return cw.writer.Write(b)
+	}
+	return cw.ResponseWriter.Write(b)
+}
+
+// send sends the header downstream, compressed or not, and what was held back.
+func (cw *compressWriter) send(compress bool) {
+	if cw.decided {
+		return
+	}
+	cw.decided = true
+	header := cw.Header()
+	if compress {
+		writer, err := encoders[cw.encoder].newWriter(cw.ResponseWriter, cw.rules.Level)
+		if err == nil {
+			cw.writer = writer
+			header.Set("Content-Encoding", encoders[cw.encoder].name)
+			header.Del("Content-Length")
+			header.Del("Accept-Ranges")
+			if etag := header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+				header.Set("ETag", "W/"+etag)
+			}
+		}
+	}
+	cw.ResponseWriter.WriteHeader(cw.status)
+	if cw.buf.Len() > 0 {
+		if cw.writer != nil {
+			cw.writer.Write(cw.buf.Bytes())
+		} else {
+			cw.ResponseWriter.Write(cw.buf.Bytes())
+		}
+		cw.buf.Reset()
+	}
+}
+
+func (cw *compressWriter) Flush() {
+	if !cw.wroteHeader {
+		return
+	}
+	//a streamed response cannot wait for MinSize bytes
+	cw.send(cw.eligible && cw.encoder >= 0 && !cw.head)
+	if flusher, ok := cw.writer.(interface{ Flush() error }); ok {
+		flusher.Flush()
+	}
+	if flusher, ok := cw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack lets upgraded connections through, uncompressed.
+func (cw *compressWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return hijack(cw.ResponseWriter)
+}
+
+func (cw *compressWriter) close() {
+	if !cw.wroteHeader {
+		return
+	}
+	//a response that ended before MinSize bytes goes out as it is
+	cw.send(false)
+	if cw.writer != nil {
+		cw.writer.Close()
+	}
+}
+
+// addVary adds a header name to Vary unless it is listed already.
+func addVary(header http.Header, name string) {
+	for _, value := range header.Values("Vary") {
+		for _, existing := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(existing), name) {
+				return
+			}
+		}
+	}
+	header.Add("Vary", name)
+}
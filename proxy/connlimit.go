@@ -0,0 +1,107 @@
+package proxy
+
+import (
+	"errors"
+	"log"
+	"net"
+	"sync"
+)
+
+var errTooManyConns = errors.New("too many connections from this address")
+
+// LimitConns caps the concurrent connections of each client IP on ln to
+// the configured max_conns_per_ip. Trusted proxies are not limited. The
+// client is only known once a PROXY protocol header is read, so the check
+// happens on the first read of the connection instead of in Accept.
+func (s *Server) LimitConns(ln net.Listener) net.Listener {
+	if s.maxConnsPerIP <= 0 {
+		return ln
+	}
+	return &connLimiter{Listener: ln, server: s, max: s.maxConnsPerIP, conns: map[string]int{}}
+}
+
+type connLimiter struct {
+	net.Listener
+	server *Server
+	max    int
+
+	mu    sync.Mutex
+	conns map[string]int
+}
+
+func (l *connLimiter) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &limitedConn{Conn: conn, limiter: l}, nil
+}
+
+// exempt reports whether the connections of ip are not counted.
+func (l *connLimiter) exempt(ip string) bool {
+	parsed := net.ParseIP(ip)
+	return parsed != nil && l.server.trusted(parsed)
+}
+
+// acquire counts a connection of ip, unless ip is over the limit.
+func (l *connLimiter) acquire(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.conns[ip] >= l.max {
+		return false
+	}
+	l.conns[ip]++
+	return true
+}
+
+func (l *connLimiter) release(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.conns[ip]--; l.conns[ip] <= 0 {
+		delete(l.conns, ip)
+	}
+}
+
+type limitedConn struct {
+	net.Conn
+	limiter *connLimiter
+
+	admit    sync.Once
+	ip       string
+	counted  bool //acquire counted the connection, so Close releases it
+	err      error
+	closeOne sync.Once
+}
+
+func (c *limitedConn) Read(b []byte) (int, error) {
+	c.admit.Do(func() {
+		c.ip = c.Conn.RemoteAddr().String()
+		if host, _, err := net.SplitHostPort(c.ip); err == nil {
+			c.ip = host
+		}
+		if c.limiter.exempt(c.ip) {
+			return
+		}
+		if c.counted = c.limiter.acquire(c.ip); !c.counted {
+			log.Printf("Connection limit: refusing %s, %d connections open", c.ip, c.limiter.max)
+			c.err = errTooManyConns
+			c.Conn.Close()
+		}
+	})
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *limitedConn) Close() error {
+	err := c.Conn.Close()
+	c.closeOne.Do(func() {
+		//Close may race the first Read, so wait for the admission
+		c.admit.Do(func() {})
+		if c.counted {
+			c.limiter.release(c.ip)
+		}
+	})
+	return err
+}
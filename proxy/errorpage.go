@@ -0,0 +1,117 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+
+	"slashing/config"
+)
+
+// errorPages are the error pages of a host, read once at startup.
+type errorPages struct {
+	pages       map[int][]byte
+	intercept   bool
+	maintenance []byte //nil when there is no maintenance page
+	retryAfter  string //seconds, empty for no Retry-After
+}
+
+// newErrorPages reads the pages of rules. It returns nil when the host has
+// none.
+func newErrorPages(rules *config.ErrorPages) (*errorPages, error) {
+	if rules == nil {
+		return nil, nil
+	}
+	p := &errorPages{pages: map[int][]byte{}, intercept: rules.Intercept}
+	for code, file := range rules.Pages {
+		page, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("error_page: %v", err)
+		}
+		p.pages[code] = page
+	}
+	if rules.Maintenance != "" {
+		page, err := ioutil.ReadFile(rules.Maintenance)
+		if err != nil {
+			return nil, fmt.Errorf("maintenance_page: %v", err)
+		}
+		p.maintenance = page
+	}
+	if rules.RetryAfter > 0 {
+		p.retryAfter = strconv.Itoa(int(rules.RetryAfter.Seconds()))
+	}
+	return p, nil
+}
+
+// serve writes the page of status, if the host has one.
+func (p *errorPages) serve(w http.ResponseWriter, status int) bool {
+	if p == nil || p.pages[status] == nil {
+		return false
+	}
+	writePage(w, status, p.pages[status])
+	return true
+}
+
+// interceptResponse replaces an error response of a backend with the page
+// of its status. The headers that describe the body go, the others stay.
+func (p *errorPages) interceptResponse(resp *http.Response) {
+	if p == nil || !p.intercept || p.pages[resp.StatusCode] == nil || isGRPC(resp.Request) {
+		return
+	}
+	page := p.pages[resp.StatusCode]
+	resp.Body.Close()
+	resp.Body = ioutil.NopCloser(bytes.NewReader(page))
+	resp.ContentLength = int64(len(page))
+	resp.TransferEncoding = nil
+	for _, name := range []string{"Content-Encoding", "ETag", "Last-Modified", "Content-Range"} {
+		resp.Header.Del(name)
+	}
+	setPageHeaders(resp.Header, page)
+}
+
+func writePage(w http.ResponseWriter, status int, page []byte) {
+	setPageHeaders(w.Header(), page)
+	w.WriteHeader(status)
+	w.Write(page)
+}
+
+func setPageHeaders(header http.Header, page []byte) {
+	header.Set("Content-Type", "text/html; charset=utf-8")
+	header.Set("Content-Length", strconv.Itoa(len(page)))
+	//the error is not the resource, caches must not keep it
+	header.Set("Cache-Control", "no-store")
+}
+
+// notFound answers 404 with the page of the host, or the plain text one.
+func (p *errorPages) notFound(w http.ResponseWriter, r *http.Request) {
+	if !p.serve(w, http.StatusNotFound) {
+		http.NotFound(w, r)
+	}
+}
+
+// badGateway answers 502 after a backend failed.
+func (p *errorPages) badGateway(w http.ResponseWriter) {
+	if !p.serve(w, http.StatusBadGateway) {
+		w.WriteHeader(http.StatusBadGateway)
+	}
+}
+
+// noBackend answers a request whose pool has no usable backend: with the
+// maintenance page, or the page of 502.
+func (p *errorPages) noBackend(w http.ResponseWriter, r *http.Request, pool *Pool) {
+	log.Printf("No backend for %s%s (pool %s)", r.Host, r.URL.Path, pool.Name)
+	switch {
+	case isGRPC(r):
+		grpcError(w, grpcUnavailable, "no upstream available")
+	case p != nil && p.maintenance != nil:
+		if p.retryAfter != "" {
+			w.Header().Set("Retry-After", p.retryAfter)
+		}
+		writePage(w, http.StatusServiceUnavailable, p.maintenance)
+	case !p.serve(w, http.StatusBadGateway):
+		http.Error(w, "No upstream available for this host", http.StatusBadGateway)
+	}
+}
@@ -0,0 +1,204 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"slashing/fastcgi"
+)
+
+// maxFastCGIBody bounds the request bodies of unknown length, which are read
+// into memory because FastCGI responders want a CONTENT_LENGTH.
+const maxFastCGIBody = 64 << 20
+
+// script reports whether urlPath names a script of a FastCGI pool, which
+// must never be served as a static file.
+func (p *Pool) script(urlPath string) bool {
+	return p.fastcgi != nil && p.fastcgi.SplitPath.MatchString(urlPath)
+}
+
+// fastCGIScript maps a request path to the script that serves it and the
+// PATH_INFO, like nginx: /a.php/b runs /a.php, a directory its index script
+// and any other path the index script of the root, as a front controller.
+func (p *Pool) fastCGIScript(root, urlPath string) (string, string, bool) {
+	rules := p.fastcgi
+	script, pathInfo := "", ""
+	if m := rules.SplitPath.FindStringSubmatch(urlPath); m != nil {
+		script, pathInfo = m[1], m[2]
+	} else if strings.HasSuffix(urlPath, "/") && isFile(filepath.Join(root, filepath.FromSlash(path.Clean(urlPath)), rules.Index)) {
+		script = urlPath + rules.Index
+	} else {
+		script = "/" + rules.Index
+	}
+	script = path.Clean("/" + script)
+	return script, pathInfo, isFile(filepath.Join(root, filepath.FromSlash(script)))
+}
+
+func isFile(name string) bool {
+	info, err := os.Stat(name)
+	return err == nil && info.Mode().IsRegular()
+}
+
+// serveFastCGI runs the script of r on a backend of a FastCGI pool.
+func (s *Server) serveFastCGI(w http.ResponseWriter, r *http.Request, rt *route, pool *Pool) {
+	root := pool.fastcgi.Root
+	if root == "" {
+		root = rt.docRoot
+	}
+	script, pathInfo, ok := pool.fastCGIScript(root, r.URL.Path)
+	if !ok {
+		rt.pages.notFound(w, r)
+		return
+	}
+	if r.ContentLength < 0 {
+		body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxFastCGIBody+1))
+		if err != nil {
+			http.Error(w, "Cannot read request body", http.StatusBadRequest)
+			return
+		}
+		if len(body) > maxFastCGIBody {
+			http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		r.ContentLength = int64(len(body))
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+
+	backend := pool.Next(r)
+	if backend == nil {
+		rt.pages.noBackend(w, r, pool)
+		return
+	}
+	atomic.AddInt64(&backend.active, 1)
+	defer atomic.AddInt64(&backend.active, -1)
+
+	start := time.Now()
+	params := s.fastCGIParams(r, root, script, pathInfo)
+	for name, value := range pool.fastcgi.Params {
+		params[name] = value
+	}
+	resp, err := doFastCGI(r.Context(), backend.Address, params, r.Body, fastCGILog{backend.Address})
+	setUpstream(r, backend, time.Since(start))
+	if err != nil {
+		if r.Context().Err() != nil {
+			backend.breaker.release()
+		} else {
+			backend.breaker.report(false)
+		}
+		log.Printf("FastCGI error from %s: %v", backend.Address, err)
+		rt.pages.badGateway(w)
+		return
+	}
+	backend.breaker.report(resp.StatusCode < 500)
+	resp.Request = r
+	rt.pages.interceptResponse(resp)
+	defer resp.Body.Close()
+	for name, values := range resp.Header {
+		w.Header()[name] = values
+	}
+	w.WriteHeader(resp.StatusCode)
+	flusher, _ := w.(http.Flusher)
+	buf := make([]byte, 32<<10)
+	for {
+		n, err := resp.Body.Read(buf)
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return
+			}
+			if flusher != nil {
+				//scripts that flush their output want it to reach the client
+				flusher.Flush()
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// doFastCGI dials a FastCGI backend, host:port or unix:/path, and sends it
+// a request.
+func doFastCGI(ctx context.Context, address string, params map[string]string, stdin io.Reader, stderr io.Writer) (*http.Response, error) {
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+	network := "tcp"
+	if strings.HasPrefix(address, "unix:") {
+		network, address = "unix", strings.TrimPrefix(address, "unix:")
+	}
+	conn, err := dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	return fastcgi.Do(ctx, conn, params, stdin, stderr)
+}
+
+// fastCGIParams are the CGI variables of r, as nginx `fastcgi_params` sets
+// them.
+func (s *Server) fastCGIParams(r *http.Request, root, script, pathInfo string) map[string]string {
+	params := map[string]string{
+		"GATEWAY_INTERFACE": "CGI/1.1",
+		"SERVER_SOFTWARE":   "slashing",
+		"SERVER_PROTOCOL":   r.Proto,
+		"SERVER_NAME":       hostName(r.Host),
+		"REQUEST_METHOD":    r.Method,
+		"REQUEST_URI":       r.URL.RequestURI(),
+		"REQUEST_SCHEME":    s.scheme(r),
+		"QUERY_STRING":      r.URL.RawQuery,
+		"DOCUMENT_ROOT":     root,
+		"DOCUMENT_URI":      r.URL.Path,
+		"SCRIPT_NAME":       script,
+		"SCRIPT_FILENAME":   filepath.Join(root, filepath.FromSlash(script)),
+		"PATH_INFO":         pathInfo,
+		"REMOTE_ADDR":       clientIP(r),
+		"CONTENT_TYPE":      r.Header.Get("Content-Type"),
+		"CONTENT_LENGTH":    "",
+		"REDIRECT_STATUS":   "200", //php-cgi refuses to run without it
+	}
+	if r.ContentLength > 0 {
+		params["CONTENT_LENGTH"] = strconv.FormatInt(r.ContentLength, 10)
+	}
+	if pathInfo != "" {
+		params["PATH_TRANSLATED"] = filepath.Join(root, filepath.FromSlash(pathInfo))
+	}
+	if params["REQUEST_SCHEME"] == "https" {
+		params["HTTPS"] = "on"
+	}
+	if addr := clientTCPAddr(r); addr != nil && addr.Port != 0 {
+		params["REMOTE_PORT"] = strconv.Itoa(addr.Port)
+	}
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		if host, port, err := net.SplitHostPort(addr.String()); err == nil {
+			params["SERVER_ADDR"], params["SERVER_PORT"] = host, port
+		}
+	}
+	for name, values := range r.Header {
+		if name == "Proxy" || name == "Content-Type" || name == "Content-Length" {
+			//Proxy would become HTTP_PROXY, the httpoxy hole
+			continue
+		}
+		params["HTTP_"+strings.ToUpper(strings.Replace(name, "-", "_", -1))] = strings.Join(values, ", ")
+	}
+	params["HTTP_HOST"] = r.Host
+	return params
+}
+
+// fastCGILog logs what the scripts of a backend write to stderr.
+type fastCGILog struct {
+	address string
+}
+
+func (l fastCGILog) Write(b []byte) (int, error) {
+	log.Printf("FastCGI stderr from %s: %s", l.address, strings.TrimRight(string(b), "\n"))
+	return len(b), nil
+}
@@ -0,0 +1,127 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// trusted reports whether ip belongs to one of the trusted proxies.
+func (s *Server) trusted(ip net.IP) bool {
+	for _, network := range s.trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// realClientIP finds the address of the client behind the trusted proxies.
+// X-Forwarded-For is walked from the right, the first address that is not a
+// trusted proxy is the client. Headers of untrusted peers are ignored.
+func (s *Server) realClientIP(r *http.Request) string {
+	peer := remoteIP(r)
+	ip := net.ParseIP(peer)
+	if ip == nil || !s.trusted(ip) {
+		return peer
+	}
+	hops := []string{}
+	for _, value := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(value, ",")...)
+	}
+	if len(hops) == 0 {
+		if realIP := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); realIP != nil {
+			return realIP.String()
+		}
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			//garbage in the chain, do not trust anything left of it
+			break
+		}
+		peer = hop.String()
+		if !s.trusted(hop) {
+			break
+		}
+	}
+	return peer
+}
+
+// withClientIP stores the real client IP of r in its context.
+func (s *Server) withClientIP(r *http.Request) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), clientIPKey, s.realClientIP(r)))
+}
+
+// clientIP returns the address of the client that sent r.
+func clientIP(r *http.Request) string {
+	if ip, ok := r.Context().Value(clientIPKey).(string); ok {
+		return ip
+	}
+	return remoteIP(r)
+}
+
+func remoteIP(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// scheme returns the scheme the client used, as told by a trusted proxy or
+// else by the connection.
+func (s *Server) scheme(r *http.Request) string {
+	if r.TLS != nil {
+		return "https"
+	}
+	if ip := net.ParseIP(remoteIP(r)); ip != nil && s.trusted(ip) {
+		if proto := strings.ToLower(r.Header.Get("X-Forwarded-Proto")); proto == "https" || proto == "http" {
+			return proto
+		}
+	}
+	return "http"
+}
+
+// setForwardedHeaders fills the forwarding headers of an outgoing request.
+// ReverseProxy appends the peer address to X-Forwarded-For itself.
+func (s *Server) setForwardedHeaders(req *http.Request) {
+	proto := "http"
+	if req.TLS != nil {
+		proto = "https"
+	}
+	ip := net.ParseIP(remoteIP(req))
+	if ip == nil || !s.trusted(ip) {
+		for _, name := range []string{"X-Forwarded-For", "X-Forwarded-Proto", "X-Forwarded-Host", "X-Real-IP", "Forwarded"} {
+			req.Header.Del(name)
+		}
+	}
+	if req.Header.Get("X-Forwarded-Proto") == "" {
+		req.Header.Set("X-Forwarded-Proto", proto)
+	}
+	if req.Header.Get("X-Forwarded-Host") == "" {
+		req.Header.Set("X-Forwarded-Host", req.Host)
+	}
+	req.Header.Set("X-Real-IP", clientIP(req))
+
+	forwarded := "for=" + forwardedNode(remoteIP(req)) + ";host=" + quoteForwarded(req.Host) + ";proto=" + proto
+	if prior := req.Header.Get("Forwarded"); prior != "" {
+		forwarded = prior + ", " + forwarded
+	}
+	req.Header.Set("Forwarded", forwarded)
+}
+
+// forwardedNode formats an address as an RFC 7239 node.
+func forwardedNode(address string) string {
+	if strings.Contains(address, ":") {
+		return `"[` + address + `]"`
+	}
+	return address
+}
+
+func quoteForwarded(value string) string {
+	if strings.ContainsAny(value, ":;,\" ") {
+		return `"` + strings.Replace(value, `"`, `\"`, -1) + `"`
+	}
+	return value
+}
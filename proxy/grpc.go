@@ -0,0 +1,117 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// gRPC status codes slashing answers with itself.
+const (
+	grpcOK          = 0
+	grpcUnavailable = 14
+)
+
+// grpcServing is the SERVING status of a grpc.health.v1 HealthCheckResponse.
+const grpcServing = 1
+
+// isGRPC reports whether r is a gRPC call.
+func isGRPC(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc")
+}
+
+// grpcError answers a gRPC call that cannot reach its backend. gRPC clients
+// expect a status in the trailers of a 200 response; a response without a
+// body carries it in its headers instead.
+func grpcError(w http.ResponseWriter, code int, message string) {
+	header := w.Header()
+	header.Set("Content-Type", "application/grpc")
+	header.Set("Grpc-Status", strconv.Itoa(code))
+	header.Set("Grpc-Message", message)
+	w.WriteHeader(http.StatusOK)
+}
+
+// grpcHealthCheck asks a backend whether service is serving, with the gRPC
+// health checking protocol. The messages are small enough to encode by hand.
+func grpcHealthCheck(client *http.Client, url, service string) error {
+	var message []byte
+	if service != "" {
+		//field 1, length delimited
+		length := make([]byte, binary.MaxVarintLen64)
+		message = append([]byte{0x0a}, length[:binary.PutUvarint(length, uint64(len(service)))]...)
+		message = append(message, service...)
+	}
+	frame := make([]byte, 5, 5+len(message))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(message)))
+	frame = append(frame, message...)
+
+	req, err := http.NewRequest(http.MethodPost, url+"/grpc.health.v1.Health/Check", bytes.NewReader(frame))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return &statusError{resp.StatusCode}
+	}
+	status := resp.Trailer.Get("Grpc-Status")
+	if status == "" {
+		status = resp.Header.Get("Grpc-Status")
+	}
+	if status != strconv.Itoa(grpcOK) {
+		return fmt.Errorf("grpc status %s: %s", status, resp.Trailer.Get("Grpc-Message")+resp.Header.Get("Grpc-Message"))
+	}
+	if len(body) < 5 || body[0] != 0 {
+		return errors.New("grpc health check: no uncompressed response message")
+	}
+	if serving := healthStatus(body[5:]); serving != grpcServing {
+		return fmt.Errorf("grpc health check: status %d, not SERVING", serving)
+	}
+	return nil
+}
+
+// healthStatus reads the status field of a HealthCheckResponse, 0 when it
+// is missing or the message is malformed.
+func healthStatus(message []byte) uint64 {
+	for len(message) > 0 {
+		key, n := binary.Uvarint(message)
+		if n <= 0 {
+			return 0
+		}
+		message = message[n:]
+		switch key & 7 {
+		case 0:
+			value, n := binary.Uvarint(message)
+			if n <= 0 {
+				return 0
+			}
+			if key>>3 == 1 {
+				return value
+			}
+			message = message[n:]
+		case 2:
+			length, n := binary.Uvarint(message)
+			if n <= 0 || uint64(len(message)-n) < length {
+				return 0
+			}
+			message = message[n+int(length):]
+		default:
+			return 0
+		}
+	}
+	return 0
+}
@@ -0,0 +1,129 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"slashing/config"
+)
+
+// withRequestID gives r an ID: the X-Request-ID of a trusted proxy, or a
+// new random one.
+func (s *Server) withRequestID(r *http.Request) *http.Request {
+	id := r.Header.Get("X-Request-ID")
+	if ip := net.ParseIP(remoteIP(r)); id == "" || len(id) > 128 || ip == nil || !s.trusted(ip) {
+		b := make([]byte, 16)
+		rand.Read(b)
+		id = hex.EncodeToString(b)
+	}
+	return r.WithContext(context.WithValue(r.Context(), requestIDKey, id))
+}
+
+// requestID returns the ID of r.
+func requestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey).(string)
+	return id
+}
+
+// applyHeaderRules changes header as the rules say, expanding the variables
+// of their values for r.
+func (s *Server) applyHeaderRules(header http.Header, rules []*config.HeaderRule, r *http.Request) {
+	for _, rule := range rules {
+		value := rule.Value
+		if strings.Contains(value, "$") {
+			value = os.Expand(value, func(name string) string {
+				switch name {
+				case "client_ip":
+					return clientIP(r)
+				case "host":
+					return hostName(r.Host)
+				case "scheme":
+					return s.scheme(r)
+				case "request_id":
+					return requestID(r)
+				}
+				return "$" + name
+			})
+		}
+		switch rule.Op {
+		case config.HeaderSet:
+			header.Set(rule.Name, value)
+		case config.HeaderAdd:
+			header.Add(rule.Name, value)
+		case config.HeaderRemove:
+			header.Del(rule.Name)
+		}
+	}
+}
+
+// requestHeadersHandler changes the request headers before the request is
+// served, so the upstream and the cache see the changed ones.
+func (s *Server) requestHeadersHandler(next http.Handler, rules []*config.HeaderRule) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r2 := new(http.Request)
+		*r2 = *r
+		r2.Header = r.Header.Clone()
+		s.applyHeaderRules(r2.Header, rules, r)
+		next.ServeHTTP(w, r2)
+	})
+}
+
+// responseHeadersHandler changes the headers of every response of a route,
+// including errors and the answers of the other middlewares.
+func (s *Server) responseHeadersHandler(next http.Handler, rules []*config.HeaderRule) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(&headerWriter{ResponseWriter: w, apply: func(header http.Header) {
+			s.applyHeaderRules(header, rules, r)
+		}}, r)
+	})
+}
+
+// headerWriter calls apply on the header right before it is sent.
+type headerWriter struct {
+	http.ResponseWriter
+	apply       func(http.Header)
+	wroteHeader bool
+}
+
+func (hw *headerWriter) WriteHeader(status int) {
+	if !hw.wroteHeader {
+		hw.wroteHeader = true
+		hw.apply(hw.Header())
+	}
+	hw.ResponseWriter.WriteHeader(status)
+}
+
+func (hw *headerWriter) Write(b []byte) (int, error) {
+	if !hw.wroteHeader {
+		if hw.Header().Get("Content-Type") == "" {
+			hw.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		hw.WriteHeader(http.StatusOK)
+	}
+	return hw.ResponseWriter.Write(b)
+}
+
+// Hijack lets upgraded connections through. The rules apply to the header
+// of the 101 response, which the proxy writes from it.
+func (hw *headerWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if !hw.wroteHeader {
+		hw.wroteHeader = true
+		hw.apply(hw.Header())
+	}
+	return hijack(hw.ResponseWriter)
+}
+
+func (hw *headerWriter) Flush() {
+	if !hw.wroteHeader {
+		hw.WriteHeader(http.StatusOK)
+	}
+	if flusher, ok := hw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
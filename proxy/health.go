@@ -0,0 +1,124 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+
+	"slashing/config"
+)
+
+// healthChecker probes one backend periodically and takes it in and out of
+// the rotation.
+type healthChecker struct {
+	pool    *Pool
+	backend *Backend
+	check   *config.HealthCheck
+	client  *http.Client
+
+	successes int
+	failures  int
+}
+
+func (p *Pool) startHealthChecks(stop <-chan struct{}) {
+	if p.check == nil {
+		return
+	}
+	for _, backend := range p.Backends {
+		hc := &healthChecker{
+			pool:    p,
+			backend: backend,
+			check:   p.check,
+			client:  &http.Client{Timeout: p.check.Timeout, Transport: p.transport},
+		}
+		go hc.run(stop)
+	}
+}
+
+func (hc *healthChecker) run(stop <-chan struct{}) {
+	ticker := time.NewTicker(hc.check.Interval)
+	defer ticker.Stop()
+	for {
+		hc.observe(hc.probe())
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (hc *healthChecker) probe() error {
+	var resp *http.Response
+	var err error
+	if hc.check.TCP {
+		conn, err := dialBackend(hc.backend.Address, hc.check.Timeout)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+	if hc.check.GRPC {
+		return grpcHealthCheck(hc.client, hc.backend.Scheme+"://"+hc.backend.host, hc.check.Service)
+	}
+	if hc.pool.fastcgi != nil {
+		//like the ping.path of PHP-FPM, the path is the script name
+		ctx, cancel := context.WithTimeout(context.Background(), hc.check.Timeout)
+		defer cancel()
+		params := map[string]string{"REQUEST_METHOD": "GET", "SCRIPT_NAME": hc.check.Path, "SCRIPT_FILENAME": hc.check.Path, "REQUEST_URI": hc.check.Path}
+		resp, err = doFastCGI(ctx, hc.backend.Address, params, nil, nil)
+	} else {
+		resp, err = hc.get()
+	}
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return &statusError{resp.StatusCode}
+	}
+	return nil
+}
+
+func (hc *healthChecker) get() (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, hc.backend.Scheme+"://"+hc.backend.host+hc.check.Path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if hc.backend.host != hc.backend.Address {
+		//not the made up name of a unix socket, that applications would reject
+		req.Host = "localhost"
+	}
+	return hc.client.Do(req)
+}
+
+func (hc *healthChecker) observe(err error) {
+	if err == nil {
+		hc.failures = 0
+		hc.successes++
+		if !hc.backend.Healthy() && hc.successes >= hc.check.Rise {
+			hc.backend.setHealthy(true)
+			log.Printf("Health check: %s in pool %s is healthy again", hc.backend.Address, hc.pool.Name)
+		}
+		return
+	}
+	hc.successes = 0
+	hc.failures++
+	if hc.backend.Healthy() && hc.failures >= hc.check.Fall {
+		hc.backend.setHealthy(false)
+		log.Printf("Health check: %s in pool %s is unhealthy: %v", hc.backend.Address, hc.pool.Name, err)
+	}
+}
+
+type statusError struct {
+	code int
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("unexpected status %d", e.code)
+}
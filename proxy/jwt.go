@@ -0,0 +1,214 @@
+package proxy
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"slashing/config"
+)
+
+// jwtLeeway tolerates clock skew between slashing and the token issuer.
+const jwtLeeway = 30 * time.Second
+
+// jwks is a JSON Web Key Set, the public keys that tokens are checked with.
+type jwks struct {
+	keys []jwk
+}
+
+type jwk struct {
+	id  string
+	alg string      //optional, restricts the key to one algorithm
+	key interface{} //*rsa.PublicKey, *ecdsa.PublicKey or []byte
+}
+
+func parseJWKS(data []byte) (interface{}, error) {
+	var document struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Alg string `json:"alg"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+			K   string `json:"k"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &document); err != nil {
+		return nil, err
+	}
+	set := &jwks{}
+	for i, k := range document.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key := jwk{id: k.Kid, alg: k.Alg}
+		var err error
+		switch k.Kty {
+		case "RSA":
+			var n, e []byte
+			if n, err = decodeSegment(k.N); err == nil {
+				e, err = decodeSegment(k.E)
+			}
+			key.key = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		case "EC":
+			curves := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}
+			curve, ok := curves[k.Crv]
+			if !ok {
+				err = fmt.Errorf("unsupported curve %q", k.Crv)
+				break
+			}
+			var x, y []byte
+			if x, err = decodeSegment(k.X); err == nil {
+				y, err = decodeSegment(k.Y)
+			}
+			key.key = &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		case "oct":
+			key.key, err = decodeSegment(k.K)
+		default:
+			err = fmt.Errorf("unsupported key type %q", k.Kty)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("key %d: %v", i, err)
+		}
+		set.keys = append(set.keys, key)
+	}
+	if len(set.keys) == 0 {
+		return nil, errors.New("no signing keys")
+	}
+	return set, nil
+}
+
+func decodeSegment(segment string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(segment, "="))
+}
+
+// verify checks the signature of a compact JWS token with the keys of the
+// set, then its time claims and the issuer and audience the rules ask for.
+func (set *jwks) verify(token string, rules *config.Auth, now time.Time) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return errors.New("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJSONSegment(parts[0], &header); err != nil {
+		return errors.New("malformed token header")
+	}
+	signature, err := decodeSegment(parts[2])
+	if err != nil {
+		return errors.New("malformed token signature")
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+	verified := false
+	for _, key := range set.keys {
+		if header.Kid != "" && key.id != "" && key.id != header.Kid || key.alg != "" && key.alg != header.Alg {
+			continue
+		}
+		if verified = verifySignature(header.Alg, key.key, signed, signature); verified {
+			break
+		}
+	}
+	if !verified {
+		return errors.New("bad signature")
+	}
+
+	var claims struct {
+		Exp *float64    `json:"exp"`
+		Nbf *float64    `json:"nbf"`
+		Iss string      `json:"iss"`
+		Aud interface{} `json:"aud"`
+	}
+	if err := decodeJSONSegment(parts[1], &claims); err != nil {
+		return errors.New("malformed token claims")
+	}
+	if claims.Exp != nil && now.Add(-jwtLeeway).After(time.Unix(int64(*claims.Exp), 0)) {
+		return errors.New("token expired")
+	}
+	if claims.Nbf != nil && now.Add(jwtLeeway).Before(time.Unix(int64(*claims.Nbf), 0)) {
+		return errors.New("token not valid yet")
+	}
+	if rules.Issuer != "" && claims.Iss != rules.Issuer {
+		return errors.New("wrong issuer")
+	}
+	if rules.Audience != "" && !hasAudience(claims.Aud, rules.Audience) {
+		return errors.New("wrong audience")
+	}
+	return nil
+}
+
+func decodeJSONSegment(segment string, v interface{}) error {
+	data, err := decodeSegment(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// hasAudience reports whether an aud claim, a string or a list of them,
+// names audience.
+func hasAudience(aud interface{}, audience string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == audience
+	case []interface{}:
+		for _, a := range aud {
+			if a == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func verifySignature(alg string, key interface{}, signed, signature []byte) bool {
+	hashes := map[string]crypto.Hash{"256": crypto.SHA256, "384": crypto.SHA384, "512": crypto.SHA512}
+	if len(alg) != 5 {
+		return false
+	}
+	hash, ok := hashes[alg[2:]]
+	if !ok {
+		return false
+	}
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if alg[:2] != "RS" {
+			return false
+		}
+		h := hash.New()
+		h.Write(signed)
+		return rsa.VerifyPKCS1v15(key, hash, h.Sum(nil), signature) == nil
+	case *ecdsa.PublicKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if alg[:2] != "ES" || len(signature) != 2*size {
+			return false
+		}
+		h := hash.New()
+		h.Write(signed)
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		return ecdsa.Verify(key, h.Sum(nil), r, s)
+	case []byte:
+		if alg[:2] != "HS" {
+			return false
+		}
+		mac := hmac.New(hash.New, key)
+		mac.Write(signed)
+		return hmac.Equal(mac.Sum(nil), signature)
+	}
+	return false
+}
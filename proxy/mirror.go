@@ -0,0 +1,194 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"slashing/config"
+)
+
+// maxMirrorsInFlight bounds the shadow requests of a route, so that a slow
+// shadow pool cannot pile up goroutines. Requests over it are not copied.
+const maxMirrorsInFlight = 100
+
+// mirror copies a sample of the requests of a route to a shadow pool and
+// compares the answers with the primary ones.
+type mirror struct {
+	route string
+	pool  *Pool
+	rules *config.Mirror
+
+	inFlight int64
+	stats    mirrorStats
+}
+
+// mirrorStats are the counters of a mirror, updated atomically.
+type mirrorStats struct {
+	Mirrored         int64 `json:"mirrored"`
+	Failed           int64 `json:"failed"`
+	Dropped          int64 `json:"dropped"`
+	StatusMismatches int64 `json:"status_mismatches"`
+	shadowNanos      int64
+	primaryNanos     int64
+	primaries        int64
+}
+
+func (s *Server) mirrorHandler(next http.Handler, rt *route, rules *config.Mirror) http.Handler {
+	m := &mirror{route: rt.name, pool: s.pools[rules.Upstream], rules: rules}
+	s.mirrors = append(s.mirrors, m)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if rand.Float64()*100 >= rules.Sample {
+			next.ServeHTTP(w, r)
+			return
+		}
+		body, ok := m.bufferBody(r)
+		if !ok || atomic.AddInt64(&m.inFlight, 1) > maxMirrorsInFlight {
+			if ok {
+				atomic.AddInt64(&m.inFlight, -1)
+			}
+			atomic.AddInt64(&m.stats.Dropped, 1)
+			next.ServeHTTP(w, r)
+			return
+		}
+		//the copy is made before the primary request goes on and may change r
+		req, cancel := s.shadowRequest(m, r, body)
+		shadow := make(chan int, 1)
+		go func() {
+			defer atomic.AddInt64(&m.inFlight, -1)
+			defer cancel()
+			shadow <- m.send(req)
+		}()
+
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r)
+		atomic.AddInt64(&m.stats.primaryNanos, int64(time.Since(start)))
+		atomic.AddInt64(&m.stats.primaries, 1)
+		go func() {
+			if status := <-shadow; status != 0 && status != sw.status {
+				atomic.AddInt64(&m.stats.StatusMismatches, 1)
+			}
+		}()
+	})
+}
+
+// bufferBody reads the request body so that both requests get it. It
+// reports false, leaving the body readable, when the body is over MaxBody.
+func (m *mirror) bufferBody(r *http.Request) ([]byte, bool) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, true
+	}
+	if r.ContentLength > m.rules.MaxBody {
+		return nil, false
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, m.rules.MaxBody+1))
+	if err != nil || int64(len(body)) > m.rules.MaxBody {
+		r.Body = readCloser{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+		return nil, false
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return body, true
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// shadowRequest copies r for the shadow pool. The copy does not depend on
+// the client connection, so it can outlive the primary request.
+func (s *Server) shadowRequest(m *mirror, r *http.Request, body []byte) (*http.Request, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(context.Background(), m.rules.Timeout)
+	ex := &exchange{pool: m.pool, backend: m.pool.Next(r), client: clientTCPAddr(r)}
+	req := r.Clone(context.WithValue(ctx, exchangeKey, ex))
+	req.RequestURI = ""
+	req.Body = http.NoBody
+	if body != nil {
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	if ex.backend != nil {
+		req.URL.Scheme, req.URL.Host = ex.backend.Scheme, ex.backend.host
+	}
+	for _, name := range hopHeaders {
+		req.Header.Del(name)
+	}
+	s.setForwardedHeaders(req)
+	forwardedFor := remoteIP(r)
+	if prior := req.Header.Get("X-Forwarded-For"); prior != "" {
+		forwardedFor = prior + ", " + forwardedFor
+	}
+	req.Header.Set("X-Forwarded-For", forwardedFor)
+	return req, cancel
+}
+
+// send sends a shadow request and returns the status of its answer, or 0
+// when it failed. It never touches the client.
+func (m *mirror) send(req *http.Request) int {
+	backend := exchangeOf(req).backend
+	if backend == nil {
+		atomic.AddInt64(&m.stats.Failed, 1)
+		return 0
+	}
+	start := time.Now()
+	atomic.AddInt64(&backend.active, 1)
+	defer atomic.AddInt64(&backend.active, -1)
+	resp, err := m.pool.transport.RoundTrip(req)
+	if err == nil {
+		backend.breaker.report(resp.StatusCode < 500)
+		_, err = io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	} else {
+		//shadow requests take trials of the breaker like the primary ones
+		backend.breaker.report(false)
+	}
+	atomic.AddInt64(&m.stats.shadowNanos, int64(time.Since(start)))
+	atomic.AddInt64(&m.stats.Mirrored, 1)
+	if err != nil {
+		atomic.AddInt64(&m.stats.Failed, 1)
+		return 0
+	}
+	return resp.StatusCode
+}
+
+type mirrorStatus struct {
+	Route string `json:"route"`
+	Pool  string `json:"pool"`
+	mirrorStats
+	ShadowLatencyMs  float64 `json:"shadow_latency_avg_ms"`
+	PrimaryLatencyMs float64 `json:"primary_latency_avg_ms"`
+}
+
+// handleMirrors lists the counters of the mirrors:
+//
+//	GET /mirrors
+func (s *Server) handleMirrors(w http.ResponseWriter, r *http.Request) {
+	statuses := []mirrorStatus{}
+	for _, m := range s.mirrors {
+		status := mirrorStatus{
+			Route: m.route,
+			Pool:  m.pool.Name,
+			mirrorStats: mirrorStats{
+				Mirrored:         atomic.LoadInt64(&m.stats.Mirrored),
+				Failed:           atomic.LoadInt64(&m.stats.Failed),
+				Dropped:          atomic.LoadInt64(&m.stats.Dropped),
+				StatusMismatches: atomic.LoadInt64(&m.stats.StatusMismatches),
+			},
+		}
+		if status.Mirrored > 0 {
+			status.ShadowLatencyMs = float64(atomic.LoadInt64(&m.stats.shadowNanos)) / float64(status.Mirrored) / 1e6
+		}
+		if primaries := atomic.LoadInt64(&m.stats.primaries); primaries > 0 {
+			status.PrimaryLatencyMs = float64(atomic.LoadInt64(&m.stats.primaryNanos)) / float64(primaries) / 1e6
+		}
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Route < statuses[j].Route })
+	writeJSON(w, statuses)
+}
@@ -0,0 +1,114 @@
+package proxy
+
+import (
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"slashing/config"
+)
+
+// Backend is one upstream server of a pool.
+type Backend struct {
+	Address string //host:port or unix:/path
+	Scheme  string //http or https, the scheme of the URLs sent to it
+	host    string //host of the URLs sent to it, stands for the socket of unix backends
+	Weight  int
+
+	down    int32 //set by the health checker, read atomically
+	active  int64 //outstanding requests, read atomically
+	breaker *breaker
+}
+
+// Healthy reports whether the backend is in the rotation.
+func (b *Backend) Healthy() bool {
+	return atomic.LoadInt32(&b.down) == 0
+}
+
+func (b *Backend) setHealthy(healthy bool) {
+	if healthy {
+		atomic.StoreInt32(&b.down, 0)
+	} else {
+		atomic.StoreInt32(&b.down, 1)
+	}
+}
+
+// Pool is a set of backends sharing one balancing state.
+type Pool struct {
+	Name     string
+	Backends []*Backend
+
+	check     *config.HealthCheck
+	balancer  Balancer
+	sticky    *sticky
+	transport http.RoundTripper
+	retry     *config.Retry
+	fastcgi   *config.FastCGI //set when the backends are fastcgi://
+
+	sendProxyProtocol int //version streams send to the backends, 0 for none
+}
+
+func newPool(upstream *config.Upstream) (*Pool, error) {
+	transport, err := newTransport(upstream)
+	if err != nil {
+		return nil, err
+	}
+	pool := &Pool{
+		Name:      upstream.Name,
+		check:     upstream.HealthCheck,
+		sticky:    newSticky(upstream.Sticky),
+		transport: transport,
+		retry:     upstream.Retry,
+
+		sendProxyProtocol: upstream.SendProxyProtocol,
+	}
+	if len(upstream.Backends) > 0 && upstream.Backends[0].Scheme == "fastcgi" {
+		pool.fastcgi = upstream.FastCGI
+		if pool.fastcgi == nil {
+			pool.fastcgi = &config.FastCGI{Index: "index.php", SplitPath: config.DefaultFastCGISplitPath}
+		}
+	}
+	for i, b := range upstream.Backends {
+		host := b.Address
+		if strings.HasPrefix(host, "unix:") {
+			host = socketHost(i)
+		}
+		scheme := b.Scheme
+		if scheme == "h2c" {
+			//the transport of the pool speaks HTTP/2 to http:// URLs
+			scheme = "http"
+		}
+		pool.Backends = append(pool.Backends, &Backend{
+			Address: b.Address,
+			Scheme:  scheme,
+			host:    host,
+			Weight:  b.Weight,
+			breaker: newBreaker(upstream.Breaker, upstream.Name+"/"+b.Address),
+		})
+	}
+	pool.balancer = newBalancer(upstream.Balance, pool.Backends)
+	return pool, nil
+}
+
+// Next picks the healthy backend that serves r, or nil if there is none.
+func (p *Pool) Next(r *http.Request) *Backend {
+	if len(p.Backends) == 0 {
+		return nil
+	}
+	if p.sticky != nil {
+		if backend := p.pinned(r); backend != nil {
+			return backend
+		}
+	}
+	for {
+		backend := p.balancer.Pick(r, p.Backends, usable)
+		if backend == nil || backend.breaker.allow() {
+			return backend
+		}
+		//lost the last half-open trial to a concurrent request, pick again
+	}
+}
+
+func usable(b *Backend) bool {
+	return b.Healthy() && b.breaker.ready()
+}
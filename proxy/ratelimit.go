@@ -0,0 +1,271 @@
+package proxy
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"slashing/config"
+	"slashing/redis/hashmap"
+)
+
+// rateLimitPrefix namespaces the counters kept in the embedded KV store, so
+// that applications using the Redis port can read them.
+const rateLimitPrefix = "slashing:ratelimit:"
+
+// counterStore keeps the state of the rate limiters. Values are plain text:
+// a count for sliding windows, "tokens updated" for token buckets.
+type counterStore interface {
+	get(key string) []byte
+	set(key string, value []byte, ttl time.Duration)
+	del(key string)
+}
+
+// memoryCounters is the process local counter store. Entries expire after
+// their ttl so idle clients do not pile up.
+type memoryCounters struct {
+	mu        sync.Mutex
+	entries   map[string]memoryCounter
+	lastSweep time.Time
+}
+
+type memoryCounter struct {
+	value   []byte
+	expires time.Time
+}
+
+func newMemoryCounters() *memoryCounters {
+	return &memoryCounters{entries: map[string]memoryCounter{}, lastSweep: time.Now()}
+}
+
+func (m *memoryCounters) get(key string) []byte {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entry, ok := m.entries[key]
+	if !ok || time.Now().After(entry.expires) {
+		return nil
+	}
+	return entry.value
+}
+
+func (m *memoryCounters) set(key string, value []byte, ttl time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	m.entries[key] = memoryCounter{value: value, expires: now.Add(ttl)}
+	if now.Sub(m.lastSweep) > time.Minute {
+		for k, entry := range m.entries {
+			if now.After(entry.expires) {
+				delete(m.entries, k)
+			}
+		}
+		m.lastSweep = now
+	}
+}
+
+func (m *memoryCounters) del(key string) {
+	m.mu.Lock()
+	delete(m.entries, key)
+	m.mu.Unlock()
+}
+
+// kvCounters keeps the counters in the embedded Redis-compatible store. The
+// store has no expiry of its own, so a value is stored as "expires value",
+// expires in Unix nanoseconds, and the expired keys are swept out.
+type kvCounters struct {
+	kv *hashmap.HashMap
+
+	mu        sync.Mutex
+	lastSweep time.Time
+}
+
+func newKVCounters(kv *hashmap.HashMap) *kvCounters {
+	c := &kvCounters{kv: kv}
+	c.sweep(time.Now())
+	return c
+}
+
+// read returns the value of key and when it expires.
+func (c *kvCounters) read(key string) ([]byte, time.Time, bool) {
+	value, ok := c.kv.Get(key)
+	if !ok {
+		return nil, time.Time{}, false
+	}
+	var data []byte
+	switch v := value.(type) {
+	case []byte:
+		data = v
+	case string:
+		data = []byte(v)
+	}
+	fields := strings.SplitN(string(data), " ", 2)
+	expires, err := strconv.ParseInt(fields[0], 10, 64)
+	if len(fields) != 2 || err != nil {
+		return nil, time.Time{}, false
+	}
+	return []byte(fields[1]), time.Unix(0, expires), true
+}
+
+func (c *kvCounters) get(key string) []byte {
+	value, expires, ok := c.read(key)
+	if !ok || time.Now().After(expires) {
+		return nil
+	}
+	return value
+}
+
+func (c *kvCounters) set(key string, value []byte, ttl time.Duration) {
+	now := time.Now()
+	c.kv.Set(key, []byte(strconv.FormatInt(now.Add(ttl).UnixNano(), 10)+" "+string(value)))
+	c.mu.Lock()
+	due := now.Sub(c.lastSweep) > time.Minute
+	c.mu.Unlock()
+	if due {
+		c.sweep(now)
+	}
+}
+
+func (c *kvCounters) del(key string) {
+	c.kv.Del(key)
+}
+
+// sweep deletes the expired counters, and the unreadable ones.
+func (c *kvCounters) sweep(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, k := range c.kv.Keys() {
+		key, ok := k.(string)
+		if !ok || !strings.HasPrefix(key, rateLimitPrefix) {
+			continue
+		}
+		if _, expires, ok := c.read(key); !ok || now.After(expires) {
+			c.kv.Del(key)
+		}
+	}
+	c.lastSweep = now
+}
+
+// rateLimiter limits the request rate of the clients of one route.
+type rateLimiter struct {
+	rules *config.RateLimit
+	name  string //the route, part of every counter key
+	store counterStore
+	mu    sync.Mutex //read-modify-write of the counters
+}
+
+func (s *Server) newRateLimiter(rt *route, rules *config.RateLimit) *rateLimiter {
+	l := &rateLimiter{rules: rules, name: rt.name, store: s.counters}
+	if rules.Store == config.CacheStoreKV {
+		if s.kv == nil {
+			log.Println("Rate limit: no embedded KV store, counting in memory instead")
+		} else {
+			l.store = s.kvCounters
+		}
+	}
+	return l
+}
+
+// rateLimitHandler answers 429 Too Many Requests to the clients over the
+// limit of the route.
+func (s *Server) rateLimitHandler(next http.Handler, rt *route, rules *config.RateLimit) http.Handler {
+	limiter := s.newRateLimiter(rt, rules)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ok, wait := limiter.allow(limiter.key(r), time.Now())
+		if !ok {
+			seconds := int(math.Ceil(wait.Seconds()))
+			if seconds < 1 {
+				seconds = 1
+			}
+			w.Header().Set("Retry-After", strconv.Itoa(seconds))
+			http.Error(w, "Too many requests", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// key returns the counter key of the client sending r. Requests without
+// the configured header or cookie are counted by client IP.
+func (l *rateLimiter) key(r *http.Request) string {
+	key := rateLimitPrefix + l.name + ":"
+	switch l.rules.Key {
+	case "route":
+		return key + "route"
+	case "header":
+		if value := r.Header.Get(l.rules.KeyName); value != "" {
+			return key + "header:" + value
+		}
+	case "cookie":
+		if cookie, err := r.Cookie(l.rules.KeyName); err == nil && cookie.Value != "" {
+			return key + "cookie:" + cookie.Value
+		}
+	}
+	return key + "ip:" + clientIP(r)
+}
+
+// allow counts a request under key. When the request is over the limit it
+// returns false and how long the client should wait.
+func (l *rateLimiter) allow(key string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rules.Algorithm == config.RateLimitSlidingWindow {
+		return l.slidingWindow(key, now)
+	}
+	return l.tokenBucket(key, now)
+}
+
+// tokenBucket refills Limit tokens per Period up to Burst, each request
+// takes one.
+func (l *rateLimiter) tokenBucket(key string, now time.Time) (bool, time.Duration) {
+	perNano := float64(l.rules.Limit) / float64(l.rules.Period)
+	burst := float64(l.rules.Burst)
+	tokens := burst
+	if state := strings.Fields(string(l.store.get(key))); len(state) == 2 {
+		stored, err1 := strconv.ParseFloat(state[0], 64)
+		updated, err2 := strconv.ParseInt(state[1], 10, 64)
+		if err1 == nil && err2 == nil {
+			tokens = math.Min(burst, stored+float64(now.UnixNano()-updated)*perNano)
+		}
+	}
+	ok := tokens >= 1
+	if ok {
+		tokens--
+	}
+	ttl := time.Duration(burst / perNano)
+	l.store.set(key, []byte(fmt.Sprintf("%.6f %d", tokens, now.UnixNano())), ttl)
+	if ok {
+		return true, 0
+	}
+	return false, time.Duration((1 - tokens) / perNano)
+}
+
+// slidingWindow counts the requests of the current and the previous fixed
+// window, weighting the previous one by how much of it still overlaps the
+// sliding window ending now.
+func (l *rateLimiter) slidingWindow(key string, now time.Time) (bool, time.Duration) {
+	period := int64(l.rules.Period)
+	window := now.UnixNano() / period
+	elapsed := float64(now.UnixNano()-window*period) / float64(period)
+	count := func(window int64) float64 {
+		n, _ := strconv.Atoi(string(l.store.get(key + ":" + strconv.FormatInt(window, 10))))
+		return float64(n)
+	}
+	previous, current := count(window-1), count(window)
+	limit := float64(l.rules.Limit)
+	if previous*(1-elapsed)+current+1 > limit {
+		wait := time.Duration(float64(period) * (1 - elapsed))
+		if current+1 <= limit && previous > 0 {
+			//the previous window fades out before this one ends
+			wait = time.Duration(float64(period) * (1 - (limit-1-current)/previous - elapsed))
+		}
+		return false, wait
+	}
+	l.store.set(key+":"+strconv.FormatInt(window, 10), []byte(strconv.Itoa(int(current)+1)), 2*l.rules.Period)
+	l.store.del(key + ":" + strconv.FormatInt(window-2, 10))
+	return true, 0
+}
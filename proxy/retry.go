@@ -0,0 +1,143 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+var errTryTimeout = errors.New("backend did not answer within per_try_timeout")
+
+// roundTripWithRetries sends req to the backend of its exchange and, when
+// that fails in a way that is safe to repeat, to other backends of the pool.
+func roundTripWithRetries(req *http.Request) (*http.Response, error) {
+	ex := exchangeOf(req)
+	retry := ex.pool.retry
+	start := time.Now()
+	tried := map[*Backend]bool{}
+	for attempt := 1; ; attempt++ {
+		tried[ex.backend] = true
+		timeout := retry.PerTryTimeout
+		if retry.Deadline > 0 {
+			if left := retry.Deadline - time.Since(start); timeout == 0 || left < timeout {
+				timeout = left
+			}
+		}
+		resp, err := ex.pool.roundTrip(req, timeout)
+		if err == nil {
+			return resp, nil
+		}
+		if req.Context().Err() != nil || attempt >= retry.Attempts || !ex.retryable(req, err) {
+			return nil, err
+		}
+		if retry.Deadline > 0 && time.Since(start) >= retry.Deadline {
+			return nil, err
+		}
+		next := ex.pool.nextExcept(req, tried)
+		if next == nil {
+			return nil, err
+		}
+		log.Printf("Retrying %s %s on %s, %s failed: %v", req.Method, req.URL.Path, next.Address, ex.backend.Address, err)
+		ex.backend.breaker.report(false)
+		atomic.AddInt64(&ex.backend.active, -1)
+		atomic.AddInt64(&next.active, 1)
+		ex.backend = next
+
+		req = req.Clone(req.Context())
+		req.URL.Scheme, req.URL.Host = next.Scheme, next.host
+		if ex.body != nil {
+			req.Body = ioutil.NopCloser(bytes.NewReader(ex.body))
+		}
+	}
+}
+
+// retryable reports whether a request that failed with err may be sent
+// again. A request that never reached the backend can always be repeated if
+// its body can; other failures only for idempotent methods and buffered
+// bodies.
+func (ex *exchange) retryable(req *http.Request, err error) bool {
+	if req.Body != nil && req.Body != http.NoBody {
+		//a body kept in full can be replayed, a streamed one cannot
+		return ex.body != nil
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return true
+	}
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	return false
+}
+
+// bufferBody reads the body of r into memory when it is small enough to be
+// sent again, so that a retry can replay it.
+func (ex *exchange) bufferBody(r *http.Request, max int64) error {
+	if r.Body == nil || r.Body == http.NoBody || r.ContentLength < 0 || r.ContentLength > max {
+		return nil
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, max))
+	r.Body.Close()
+	if err != nil {
+		return err
+	}
+	ex.body = body
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return nil
+}
+
+// roundTrip sends req through the pool's transport. A positive timeout
+// bounds the wait for the response headers, not the body.
+func (p *Pool) roundTrip(req *http.Request, timeout time.Duration) (*http.Response, error) {
+	if timeout <= 0 {
+		return p.transport.RoundTrip(req)
+	}
+	ctx, cancel := context.WithCancel(req.Context())
+	timer := time.AfterFunc(timeout, cancel)
+	resp, err := p.transport.RoundTrip(req.WithContext(ctx))
+	if !timer.Stop() {
+		//the timer fired, whatever came back is too late
+		if err == nil {
+			resp.Body.Close()
+		}
+		cancel()
+		return nil, errTryTimeout
+	}
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// cancelBody releases the context of a try once its body is closed.
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// nextExcept picks a backend of the pool that is not in tried.
+func (p *Pool) nextExcept(r *http.Request, tried map[*Backend]bool) *Backend {
+	untried := func(b *Backend) bool { return !tried[b] && usable(b) }
+	for {
+		backend := p.balancer.Pick(r, p.Backends, untried)
+		if backend == nil || backend.breaker.allow() {
+			return backend
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"path"
+	"strings"
+
+	"slashing/config"
+)
+
+// rewrite normalises a request before its route is picked: canonical host,
+// trailing slash, then the rewrite rules of the host in order. It returns
+// the rewritten request, or false when it answered with a redirect.
+func (s *Server) rewrite(w http.ResponseWriter, r *http.Request, h *host) (*http.Request, bool) {
+	if h.canonical != "" && hostName(r.Host) != h.canonical {
+		target := s.scheme(r) + "://" + h.canonical
+		if _, port, err := net.SplitHostPort(r.Host); err == nil && port != "" {
+			target += ":" + port
+		}
+		redirectPermanent(w, r, target+r.URL.RequestURI())
+		return nil, false
+	}
+
+	urlPath := r.URL.Path
+	switch h.trailingSlash {
+	case config.TrailingSlashAdd:
+		if !strings.HasSuffix(urlPath, "/") && !strings.Contains(path.Base(urlPath), ".") {
+			redirectPermanent(w, r, withQuery(localPath(urlPath)+"/", r.URL.RawQuery))
+			return nil, false
+		}
+	case config.TrailingSlashRemove:
+		if trimmed := strings.TrimRight(urlPath, "/"); trimmed != urlPath && trimmed != "" {
+			redirectPermanent(w, r, withQuery(localPath(trimmed), r.URL.RawQuery))
+			return nil, false
+		}
+	}
+
+	query := r.URL.RawQuery
+	for _, rule := range h.rewrites {
+		indexes := rule.Regexp.FindStringSubmatchIndex(urlPath)
+		if indexes == nil {
+			continue
+		}
+		result := string(rule.Regexp.ExpandString(nil, rule.Replacement, urlPath, indexes))
+		if i := strings.Index(result, "?"); i >= 0 {
+			//the query of the replacement comes first, the original one is kept after it
+			result, query = result[:i], joinQuery(result[i+1:], query)
+		}
+		if rule.Code != 0 {
+			if strings.HasPrefix(result, "/") {
+				result = localPath(result)
+			}
+			http.Redirect(w, r, withQuery(result, query), rule.Code)
+			return nil, false
+		}
+		urlPath = result
+	}
+	if urlPath == r.URL.Path && query == r.URL.RawQuery {
+		return r, true
+	}
+	r2 := new(http.Request)
+	*r2 = *r
+	u := *r.URL
+	u.Path, u.RawPath, u.RawQuery = urlPath, "", query
+	r2.URL = &u
+	return r2, true
+}
+
+// redirectPermanent redirects with 301, or 308 when the method must be kept.
+func redirectPermanent(w http.ResponseWriter, r *http.Request, target string) {
+	code := http.StatusMovedPermanently
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		code = http.StatusPermanentRedirect
+	}
+	http.Redirect(w, r, target, code)
+}
+
+// localPath makes a path safe for a Location header. Browsers take a path
+// starting with // or /\ for another host, so the leading slashes collapse.
+func localPath(p string) string {
+	return "/" + strings.TrimLeft(p, `/\`)
+}
+
+func withQuery(target, query string) string {
+	if query == "" {
+		return target
+	}
+	return target + "?" + query
+}
+
+func joinQuery(first, second string) string {
+	if first == "" || second == "" {
+		return first + second
+	}
+	return first + "&" + second
+}
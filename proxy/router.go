@@ -0,0 +1,155 @@
+package proxy
+
+import (
+	"net/http"
+	"path"
+	"strings"
+
+	"slashing/config"
+)
+
+// route is a location of a host, ready to serve. The fallback route of a
+// host has no action: it serves the file under Root if there is one and
+// proxies to the pool otherwise.
+type route struct {
+	*config.Location
+	name    string              //the domain and pattern, names the route's state
+	docRoot string              //root of the domain, for FastCGI scripts
+	pages   *errorPages         //of the domain, may be nil
+	options config.RouteOptions //inherited from the host
+	pool    *Pool               //proxy and fallback only
+	split   *split              //sends some clients to another pool, may be nil
+	handler http.Handler        //the action wrapped in the route's middlewares
+}
+
+// routeMatch is where a route matched the request path.
+type routeMatch struct {
+	path    string
+	indexes []int //submatch indexes of a regex location
+}
+
+// route returns the first route of the host matching urlPath, or its
+// fallback route.
+func (h *host) route(urlPath string) (*route, routeMatch) {
+	for _, rt := range h.routes {
+		if indexes, ok := rt.match(urlPath); ok {
+			return rt, routeMatch{path: urlPath, indexes: indexes}
+		}
+	}
+	return h.fallback, routeMatch{path: urlPath, indexes: []int{0, 0}}
+}
+
+func (rt *route) match(urlPath string) ([]int, bool) {
+	switch rt.Match {
+	case config.MatchExact:
+		return []int{0, len(urlPath)}, urlPath == rt.Pattern
+	case config.MatchPrefix:
+		return []int{0, len(rt.Pattern)}, strings.HasPrefix(urlPath, rt.Pattern)
+	}
+	indexes := rt.Regexp.FindStringSubmatchIndex(urlPath)
+	return indexes, indexes != nil
+}
+
+// stripped returns the request path without the matched part.
+func (rt *route) stripped(match routeMatch) string {
+	if !rt.StripPrefix || match.indexes[0] != 0 {
+		return match.path
+	}
+	rest := match.path[match.indexes[1]:]
+	if !strings.HasPrefix(rest, "/") {
+		rest = "/" + rest
+	}
+	return rest
+}
+
+// routeHandler wraps the action of a route in the middlewares its options
+// ask for.
+func (s *Server) routeHandler(rt *route) (http.Handler, error) {
+	var handler http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.serveRoute(w, r, rt, r.Context().Value(matchKey).(routeMatch))
+	})
+	if rules := rt.options.Mirror; rules != nil && rules.Upstream != "" && rt.pool != nil {
+		handler = s.mirrorHandler(handler, rt, rules)
+	}
+	if rules := rt.options.Cache; rules != nil && rules.Enabled && rt.pool != nil {
+		handler = s.cache.Handler(ownLogEntry(handler), rules)
+	}
+	if rules := rt.options.Compress; rules != nil && rules.Enabled {
+		handler = compressHandler(handler, rules)
+	}
+	if rules := rt.options.RequestHeaders; len(rules) > 0 {
+		handler = s.requestHeadersHandler(handler, rules)
+	}
+	if rules := rt.options.Auth; rules != nil && rules.Type != "" {
+		var err error
+		if handler, err = s.authHandler(handler, rules); err != nil {
+			return nil, err
+		}
+	}
+	if rules := rt.options.RateLimit; rules != nil && rules.Enabled {
+		handler = s.rateLimitHandler(handler, rt, rules)
+	}
+	if rules := rt.options.ResponseHeaders; len(rules) > 0 {
+		handler = s.responseHeadersHandler(handler, rules)
+	}
+	return handler, nil
+}
+
+func (s *Server) serveRoute(w http.ResponseWriter, r *http.Request, rt *route, match routeMatch) {
+	switch rt.Action {
+	case config.ActionRespond:
+		if rt.Target != "" {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		}
+		w.WriteHeader(rt.Code)
+		w.Write([]byte(rt.Target))
+	case config.ActionRedirect:
+		target := rt.Target
+		if rt.Regexp != nil {
+			target = string(rt.Regexp.ExpandString(nil, target, match.path, match.indexes))
+			if strings.HasPrefix(target, "/") {
+				//a capture may start with slashes of its own
+				target = localPath(target)
+			}
+		}
+		http.Redirect(w, r, target, rt.Code)
+	case config.ActionStatic:
+		urlPath := rt.stripped(match)
+		if serveFile(w, r, rt.Root, urlPath) || serveFile(w, r, rt.Root, path.Join(urlPath, "index.html")) {
+			return
+		}
+		rt.pages.notFound(w, r)
+	case config.ActionProxy:
+		if rt.StripPrefix {
+			r2 := new(http.Request)
+			*r2 = *r
+			u := *r.URL
+			u.Path, u.RawPath = rt.stripped(match), ""
+			r2.URL = &u
+			r = r2
+		}
+		s.forward(w, r, rt, rt.poolFor(r))
+	default:
+		pool := rt.poolFor(r)
+		if rt.Root != "" && !pool.script(r.URL.Path) && serveFile(w, r, rt.Root, r.URL.Path) {
+			return
+		}
+		if rt.Root != "" && len(pool.Backends) == 0 {
+			//a static site, nothing to fall through to
+			rt.pages.notFound(w, r)
+			return
+		}
+		//File not Exist
+		//Do proxying
+		s.forward(w, r, rt, pool)
+	}
+}
+
+// forward hands r to the backends of pool, over HTTP or FastCGI.
+func (s *Server) forward(w http.ResponseWriter, r *http.Request, rt *route, pool *Pool) {
+	if pool.fastcgi != nil {
+		s.serveFastCGI(w, r, rt, pool)
+		return
+	}
+	s.serveProxy(w, r, rt, pool)
+}
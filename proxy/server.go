@@ -0,0 +1,291 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"slashing/cache"
+	"slashing/config"
+	"slashing/redis/hashmap"
+)
+
+type contextKey int
+
+const (
+	exchangeKey contextKey = iota
+	clientIPKey
+	matchKey
+	requestIDKey
+	logEntryKey
+)
+
+// exchange is the state of one proxied request, carried in its context from
+// ServeHTTP to the ReverseProxy hooks.
+type exchange struct {
+	pool    *Pool
+	backend *Backend
+	client  *net.TCPAddr
+	body    []byte //request body kept for retries
+	start   time.Time
+	pages   *errorPages //of the host, may be nil
+}
+
+func exchangeOf(r *http.Request) *exchange {
+	return r.Context().Value(exchangeKey).(*exchange)
+}
+
+// Server is the HTTP handler in front of the upstream pools. It picks a host
+// by the request's Host header, serves static files from the host's root
+// and proxies everything else to the host's pools.
+type Server struct {
+	hosts     map[string]*host
+	pools     map[string]*Pool
+	proxy     *httputil.ReverseProxy
+	grpcProxy *httputil.ReverseProxy //flushes every write, for streaming calls
+	stop      chan struct{}
+	cache     *cache.Cache //nil when no route caches
+
+	splits  []*split  //canary splits of all routes, for the admin API
+	mirrors []*mirror //for the admin API
+	streams []*Stream
+
+	accessLog *accessLog          //of unknown hosts and the hosts without their own, nil when not configured
+	logFiles  map[string]*logFile //by path, shared by the hosts logging there
+
+	kv         *hashmap.HashMap //embedded store shared with the Redis port, may be nil
+	counters   *memoryCounters  //rate limits kept in memory
+	kvCounters *kvCounters      //rate limits kept in kv, nil without it
+
+	trustedProxies []*net.IPNet
+	maxConnsPerIP  int
+}
+
+type host struct {
+	pool     *Pool
+	routes   []*route //tried in order
+	fallback *route   //serves the root, then the pool, when no route matches
+
+	canonical     string //host name the other names redirect to
+	trailingSlash string
+	rewrites      []*config.Rewrite
+	accessLog     *accessLog //nil when not configured, accessLogOff when off
+}
+
+// New builds a Server from a parsed configuration. kv is the embedded
+// Redis-compatible store, used by the features that can keep their state in
+// it; it may be nil.
+func New(cfg *config.Config, kv *hashmap.HashMap) (*Server, error) {
+	s := &Server{
+		hosts:          map[string]*host{},
+		pools:          map[string]*Pool{},
+		stop:           make(chan struct{}),
+		kv:             kv,
+		counters:       newMemoryCounters(),
+		logFiles:       map[string]*logFile{},
+		trustedProxies: cfg.TrustedProxies,
+		maxConnsPerIP:  cfg.MaxConnsPerIP,
+	}
+	for name, upstream := range cfg.Upstreams {
+		pool, err := newPool(upstream)
+		if err != nil {
+			return nil, err
+		}
+		s.pools[name] = pool
+	}
+	if kv != nil {
+		s.kvCounters = newKVCounters(kv)
+	}
+	if err := s.setupCache(cfg, kv); err != nil {
+		return nil, err
+	}
+	var err error
+	if s.accessLog, err = s.newAccessLog(cfg.AccessLog); err != nil {
+		return nil, err
+	}
+	fallback := s.pools[config.DefaultUpstream]
+	for _, h := range cfg.Hosts {
+		pages, err := newErrorPages(h.ErrorPages)
+		if err != nil {
+			return nil, fmt.Errorf("domain %s: %v", h.Domain, err)
+		}
+		hh := &host{pool: s.pools[h.Domain], canonical: h.Canonical(), trailingSlash: h.TrailingSlash, rewrites: h.Rewrites, accessLog: s.accessLog}
+		if h.AccessLog != nil {
+			if hh.accessLog, err = s.newAccessLog(h.AccessLog); err != nil {
+				return nil, err
+			}
+		}
+		if len(hh.pool.Backends) == 0 && len(fallback.Backends) > 0 {
+			//hosts without their own backends share the global ones
+			hh.pool = fallback
+		}
+		for _, location := range h.Locations {
+			rt := &route{Location: location, name: h.Domain + location.Pattern, docRoot: h.Root, pages: pages, options: location.Options.Inherit(h.Options)}
+			if location.Action == config.ActionProxy {
+				rt.pool = s.pools[location.Upstream]
+				if location.Upstream == h.Domain {
+					rt.pool = hh.pool
+				}
+			}
+			hh.routes = append(hh.routes, rt)
+		}
+		hh.fallback = &route{Location: &config.Location{Root: h.Root}, name: h.Domain, docRoot: h.Root, pages: pages, options: h.Options, pool: hh.pool}
+		for _, rt := range append(hh.routes, hh.fallback) {
+			if rules := rt.options.Split; rules != nil && rules.Upstream != "" && rt.pool != nil {
+				rt.split = newSplit(rt, s.pools[rules.Upstream], rules)
+				s.splits = append(s.splits, rt.split)
+			}
+			handler, err := s.routeHandler(rt)
+			if err != nil {
+				return nil, err
+			}
+			rt.handler = handler
+		}
+		for _, name := range h.Names() {
+			if _, ok := s.hosts[name]; ok {
+				return nil, fmt.Errorf("domain %s is declared twice", name)
+			}
+			s.hosts[name] = hh
+		}
+	}
+	for _, st := range cfg.Streams {
+		stream, err := s.newStream(st)
+		if err != nil {
+			return nil, err
+		}
+		s.streams = append(s.streams, stream)
+	}
+	s.proxy = &httputil.ReverseProxy{
+		Director:       s.director,
+		ModifyResponse: s.modifyResponse,
+		ErrorHandler:   s.errorHandler,
+		Transport:      poolTransport{},
+	}
+	grpcProxy := *s.proxy
+	grpcProxy.FlushInterval = -1
+	s.grpcProxy = &grpcProxy
+	for _, pool := range s.pools {
+		pool.startHealthChecks(s.stop)
+	}
+	return s, nil
+}
+
+// Shutdown stops the background work of the server.
+func (s *Server) Shutdown(ctx context.Context) error {
+	close(s.stop)
+	return nil
+}
+
+// Domains returns the configured host names.
+func (s *Server) Domains() []string {
+	domains := make([]string, 0, len(s.hosts))
+	for domain := range s.hosts {
+		domains = append(domains, domain)
+	}
+	sort.Strings(domains)
+	return domains
+}
+
+func (s *Server) director(req *http.Request) {
+	backend := exchangeOf(req).backend
+	req.URL.Scheme = backend.Scheme
+	req.URL.Host = backend.host
+	s.setForwardedHeaders(req)
+}
+
+func (s *Server) modifyResponse(resp *http.Response) error {
+	ex := exchangeOf(resp.Request)
+	setUpstream(resp.Request, ex.backend, time.Since(ex.start))
+	ex.backend.breaker.report(resp.StatusCode < 500)
+	ex.pool.stick(resp, ex.backend)
+	ex.pages.interceptResponse(resp)
+	return nil
+}
+
+func (s *Server) errorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	ex := exchangeOf(r)
+	backend := ex.backend
+	setUpstream(r, backend, time.Since(ex.start))
+	if r.Context().Err() != nil {
+		//the client went away, that says nothing about the backend
+		backend.breaker.release()
+	} else {
+		backend.breaker.report(false)
+	}
+	log.Printf("Proxy error from %s: %v", backend.Address, err)
+	if isGRPC(r) {
+		grpcError(w, grpcUnavailable, "upstream unavailable")
+		return
+	}
+	ex.pages.badGateway(w)
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	r = s.withRequestID(s.withClientIP(r))
+	h, ok := s.hosts[hostName(r.Host)]
+	accessLog := s.accessLog
+	if ok {
+		accessLog = h.accessLog
+	}
+	switch accessLog {
+	case nil:
+		log.Println("Incoming HTTP:", clientIP(r), r.Host, r.URL.Path)
+	case accessLogOff:
+	default:
+		var entry *logEntry
+		r, entry = withLogEntry(r)
+		sw := &statusWriter{ResponseWriter: w}
+		defer accessLog.write(r, sw, entry, start)
+		w = sw
+	}
+
+	if !ok {
+		http.Error(w, "Unknown host", http.StatusNotFound)
+		return
+	}
+
+	r, ok = s.rewrite(w, r, h)
+	if !ok {
+		return
+	}
+	rt, match := h.route(r.URL.Path)
+	rt.handler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), matchKey, match)))
+}
+
+func (s *Server) serveProxy(w http.ResponseWriter, r *http.Request, rt *route, pool *Pool) {
+	backend := pool.Next(r)
+	if backend == nil {
+		rt.pages.noBackend(w, r, pool)
+		return
+	}
+	ex := &exchange{pool: pool, backend: backend, client: clientTCPAddr(r), start: time.Now(), pages: rt.pages}
+	if pool.retry != nil {
+		if err := ex.bufferBody(r, pool.retry.MaxBody); err != nil {
+			http.Error(w, "Cannot read request body", http.StatusBadRequest)
+			return
+		}
+	}
+	atomic.AddInt64(&backend.active, 1)
+	defer func() { atomic.AddInt64(&ex.backend.active, -1) }()
+	proxy := s.proxy
+	if isGRPC(r) {
+		proxy = s.grpcProxy
+	}
+	proxy.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), exchangeKey, ex)))
+}
+
+// hostName strips the port and lowercases a Host header.
+func hostName(hostport string) string {
+	if host, _, err := net.SplitHostPort(hostport); err == nil {
+		hostport = host
+	}
+	return strings.ToLower(hostport)
+}
@@ -0,0 +1,1828 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/fcgi"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/DataDog/zstd"
+	"github.com/andybalholm/brotli"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+
+	"slashing/cache"
+	"slashing/config"
+	"slashing/proxyproto"
+	"slashing/redis/hashmap"
+)
+
+func backendServer(name string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(name))
+	}))
+}
+
+func newTestServer(t *testing.T, configuration string) *Server {
+	cfg, err := config.Parse(strings.NewReader(configuration))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := New(cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func get(s http.Handler, target string) (int, string) {
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", target, nil))
+	body, _ := ioutil.ReadAll(w.Result().Body)
+	return w.Code, string(body)
+}
+
+func hostOf(server *httptest.Server) string {
+	u, _ := url.Parse(server.URL)
+	return u.Host
+}
+
+func TestHostPools(t *testing.T) {
+	a, b, api := backendServer("a"), backendServer("b"), backendServer("api")
+	defer a.Close()
+	defer b.Close()
+	defer api.Close()
+
+	s := newTestServer(t, `
+upstream=api
+backend=`+hostOf(api)+`
+domain=a.com
+backend=`+hostOf(a)+`
+proxy=/api/ api
+domain=b.com
+backend=`+hostOf(b)+`
+domain=empty.com
+`)
+	for target, want := range map[string]string{
+		"https://a.com/":          "a",
+		"https://a.com/api/users": "api",
+		"https://b.com/api/users": "b",
+	} {
+		if code, body := get(s, target); code != http.StatusOK || body != want {
+			t.Errorf("%s: got %d %q, want %q", target, code, body, want)
+		}
+	}
+	if code, _ := get(s, "https://empty.com/"); code != http.StatusBadGateway {
+		t.Error("host without pool should get 502, got", code)
+	}
+	if code, _ := get(s, "https://unknown.com/"); code != http.StatusNotFound {
+		t.Error("unknown host should get 404, got", code)
+	}
+}
+
+func TestHealthCheckTakesBackendOut(t *testing.T) {
+	healthy := true
+	sick := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/healthz" && !healthy {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("sick"))
+	}))
+	defer sick.Close()
+	well := backendServer("well")
+	defer well.Close()
+
+	s := newTestServer(t, `
+domain=a.com
+backend=`+hostOf(sick)+`
+backend=`+hostOf(well)+`
+health_check=/healthz interval=1h rise=1 fall=1
+`)
+	defer s.Shutdown(context.Background())
+	pool := s.pools["a.com"]
+	checker := &healthChecker{pool: pool, backend: pool.Backends[0], check: pool.check, client: http.DefaultClient}
+
+	healthy = false
+	checker.observe(checker.probe())
+	for i := 0; i < 4; i++ {
+		if _, body := get(s, "https://a.com/"); body != "well" {
+			t.Fatal("unhealthy backend still in rotation")
+		}
+	}
+	healthy = true
+	checker.observe(checker.probe())
+	seen := map[string]bool{}
+	for i := 0; i < 4; i++ {
+		_, body := get(s, "https://a.com/")
+		seen[body] = true
+	}
+	if !seen["sick"] {
+		t.Fatal("recovered backend did not come back")
+	}
+}
+
+func TestCircuitBreakerEjectsFailingBackend(t *testing.T) {
+	failing := true
+	flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte("flaky"))
+	}))
+	defer flaky.Close()
+	well := backendServer("well")
+	defer well.Close()
+
+	s := newTestServer(t, `
+domain=a.com
+backend=`+hostOf(flaky)+`
+backend=`+hostOf(well)+`
+circuit_breaker=max_fails=2 window=1m cooldown=50ms half_open=1
+`)
+	for i := 0; i < 4; i++ {
+		get(s, "https://a.com/")
+	}
+	if state := s.pools["a.com"].Backends[0].breaker.status(); state != breakerOpen {
+		t.Fatal("breaker should be open, is", state)
+	}
+	for i := 0; i < 4; i++ {
+		if _, body := get(s, "https://a.com/"); body != "well" {
+			t.Fatal("ejected backend still in rotation")
+		}
+	}
+	failing = false
+	time.Sleep(60 * time.Millisecond)
+	for i := 0; i < 4; i++ {
+		get(s, "https://a.com/")
+	}
+	if state := s.pools["a.com"].Backends[0].breaker.status(); state != breakerClosed {
+		t.Fatal("breaker should be closed again, is", state)
+	}
+}
+
+func TestStickyCookie(t *testing.T) {
+	a, b := backendServer("a"), backendServer("b")
+	defer a.Close()
+	defer b.Close()
+	s := newTestServer(t, `
+domain=a.com
+backend=`+hostOf(a)+`
+backend=`+hostOf(b)+`
+sticky=AFFINITY secret=test
+`)
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "https://a.com/", nil))
+	first := w.Body.String()
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != "AFFINITY" {
+		t.Fatal("expected an affinity cookie, got", cookies)
+	}
+	for _, server := range []*httptest.Server{a, b} {
+		if strings.Contains(cookies[0].Value, base64.RawURLEncoding.EncodeToString([]byte(hostOf(server)))) {
+			t.Fatal("the affinity cookie should not reveal the backend address:", cookies[0].Value)
+		}
+	}
+	for i := 0; i < 4; i++ {
+		r := httptest.NewRequest("GET", "https://a.com/", nil)
+		r.AddCookie(cookies[0])
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		if w.Body.String() != first {
+			t.Fatal("pinned request went to another backend")
+		}
+		if len(w.Result().Cookies()) != 0 {
+			t.Fatal("cookie should not be set again")
+		}
+	}
+
+	forged := *cookies[0]
+	forged.Value = forged.Value[:len(forged.Value)-2] + "xx"
+	r := httptest.NewRequest("GET", "https://a.com/", nil)
+	r.AddCookie(&forged)
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	if len(w.Result().Cookies()) != 1 {
+		t.Fatal("a forged cookie should be replaced")
+	}
+}
+
+func TestLocations(t *testing.T) {
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("api " + r.URL.Path))
+	}))
+	defer api.Close()
+	root, err := ioutil.TempDir("", "slashing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	ioutil.WriteFile(filepath.Join(root, "app.js"), []byte("js"), 0644)
+
+	s := newTestServer(t, `
+upstream=api
+backend=`+hostOf(api)+`
+domain=a.com
+location=exact /healthz
+respond=200 ok
+location=regex ^/old/(.*)$
+redirect=301 /new/$1
+location=regex ^/go/(.*)$
+redirect=302 /$1
+location=prefix /assets/
+static=`+root+`
+strip_prefix=on
+location=prefix /api/
+proxy=api
+strip_prefix=on
+`)
+	for target, want := range map[string]string{
+		"https://a.com/healthz":       "ok",
+		"https://a.com/assets/app.js": "js",
+		"https://a.com/api/users":     "api /users",
+	} {
+		if code, body := get(s, target); code != http.StatusOK || body != want {
+			t.Errorf("%s: got %d %q, want %q", target, code, body, want)
+		}
+	}
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "https://a.com/old/page", nil))
+	if w.Code != http.StatusMovedPermanently || w.Header().Get("Location") != "/new/page" {
+		t.Errorf("redirect: got %d to %q", w.Code, w.Header().Get("Location"))
+	}
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "https://a.com/go//evil.com", nil))
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "/evil.com" {
+		t.Errorf("redirect of a capture starting with //: got %d to %q", w.Code, w.Header().Get("Location"))
+	}
+	if code, _ := get(s, "https://a.com/assets/missing.js"); code != http.StatusNotFound {
+		t.Error("missing static file should be a 404, got", code)
+	}
+}
+
+func TestForwardedHeaders(t *testing.T) {
+	echo := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("X-Forwarded-For") + "|" + r.Header.Get("X-Real-IP") + "|" +
+			r.Header.Get("X-Forwarded-Host") + "|" + r.Header.Get("Forwarded")))
+	}))
+	defer echo.Close()
+	s := newTestServer(t, `
+trusted_proxies=10.0.0.0/8
+domain=a.com
+backend=`+hostOf(echo)+`
+`)
+	for _, tc := range []struct{ peer, xff, want string }{
+		{"203.0.113.9:1234", "1.2.3.4", "203.0.113.9|203.0.113.9|a.com|for=203.0.113.9;host=a.com;proto=http"},
+		{"10.0.0.2:1234", "1.2.3.4, 10.0.0.3", "1.2.3.4, 10.0.0.3, 10.0.0.2|1.2.3.4|a.com|for=10.0.0.2;host=a.com;proto=http"},
+	} {
+		r := httptest.NewRequest("GET", "http://a.com/", nil)
+		r.RemoteAddr = tc.peer
+		r.Header.Set("X-Forwarded-For", tc.xff)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		if w.Body.String() != tc.want {
+			t.Errorf("from %s: got %q, want %q", tc.peer, w.Body.String(), tc.want)
+		}
+	}
+}
+
+func TestSendProxyProtocol(t *testing.T) {
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.RemoteAddr))
+	}))
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	backend.Listener = &proxyproto.Listener{Listener: backend.Listener, Trusted: []*net.IPNet{loopback}}
+	backend.Start()
+	defer backend.Close()
+
+	s := newTestServer(t, `
+domain=a.com
+backend=`+hostOf(backend)+`
+send_proxy_protocol=v2
+`)
+	r := httptest.NewRequest("GET", "https://a.com/", nil)
+	r.RemoteAddr = "198.51.100.7:4000"
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	if w.Body.String() != "198.51.100.7:4000" {
+		t.Fatal("backend should see the client address, got", w.Body.String())
+	}
+}
+
+func TestRetryOnAnotherBackend(t *testing.T) {
+	dead := httptest.NewServer(http.NotFoundHandler())
+	deadAddress := hostOf(dead)
+	dead.Close()
+	well := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write(append([]byte("well "), body...))
+	}))
+	defer well.Close()
+
+	s := newTestServer(t, `
+domain=a.com
+backend=`+deadAddress+`
+backend=`+hostOf(well)+`
+retry=2 per_try_timeout=1s deadline=5s
+`)
+	for i := 0; i < 4; i++ {
+		if code, body := get(s, "https://a.com/"); code != http.StatusOK || body != "well " {
+			t.Fatalf("GET should have been retried, got %d %q", code, body)
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("POST", "https://a.com/", strings.NewReader("data")))
+		if w.Code != http.StatusOK || w.Body.String() != "well data" {
+			t.Fatalf("POST that never reached a backend should have been retried, got %d %q", w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestRetryBufferedBody(t *testing.T) {
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		conn, _, _ := w.(http.Hijacker).Hijack()
+		conn.Close() //the request got through, no answer comes back
+	}))
+	defer broken.Close()
+	well := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write(append([]byte("well "), body...))
+	}))
+	defer well.Close()
+
+	s := newTestServer(t, `
+domain=a.com
+backend=`+hostOf(broken)+`
+backend=`+hostOf(well)+`
+retry=2 max_body=8
+`)
+	post := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("POST", "https://a.com/", strings.NewReader(body)))
+		return w
+	}
+	for i := 0; i < 2; i++ {
+		if w := post("data"); w.Code != http.StatusOK || w.Body.String() != "well data" {
+			t.Fatalf("POST with a buffered body should have been retried, got %d %q", w.Code, w.Body.String())
+		}
+	}
+	failed := 0
+	for i := 0; i < 2; i++ {
+		if post("more than max_body").Code == http.StatusBadGateway {
+			failed++
+		}
+	}
+	if failed != 1 {
+		t.Fatalf("POST with a body over max_body should not be retried, %d of 2 failed", failed)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	page := strings.Repeat("hello world ", 200)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/small":
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte("tiny"))
+		case "/image":
+			w.Header().Set("Content-Type", "image/png")
+			w.Write([]byte(page))
+		default:
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.Header().Set("ETag", `"v1"`)
+			w.Write([]byte(page))
+		}
+	}))
+	defer backend.Close()
+	s := newTestServer(t, `
+domain=a.com
+backend=`+hostOf(backend)+`
+compress=on level=5 min_size=100
+`)
+	fetch := func(path, acceptEncoding string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "https://a.com"+path, nil)
+		r.Header.Set("Accept-Encoding", acceptEncoding)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
+
+	w := fetch("/", "br;q=0.5, gzip;q=0.8")
+	if w.Header().Get("Content-Encoding") != "gzip" || w.Header().Get("Vary") != "Accept-Encoding" || w.Header().Get("ETag") != `W/"v1"` {
+		t.Fatalf("expected a gzip response, got headers %v", w.Header())
+	}
+	zr, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body, _ := ioutil.ReadAll(zr); string(body) != page {
+		t.Fatal("gzip body does not decode to the page")
+	}
+	decoders := map[string]func(io.Reader) io.Reader{
+		"br":   func(r io.Reader) io.Reader { return brotli.NewReader(r) },
+		"zstd": func(r io.Reader) io.Reader { return zstd.NewReader(r) },
+	}
+	for encoding, decode := range decoders {
+		w := fetch("/", "gzip;q=0.8, "+encoding)
+		if w.Header().Get("Content-Encoding") != encoding {
+			t.Fatalf("expected a %s response, got headers %v", encoding, w.Header())
+		}
+		if body, _ := ioutil.ReadAll(decode(w.Body)); string(body) != page {
+			t.Fatalf("%s body does not decode to the page", encoding)
+		}
+	}
+
+	if w := fetch("/", ""); w.Header().Get("Content-Encoding") != "" || w.Header().Get("Vary") != "Accept-Encoding" {
+		t.Fatalf("client without Accept-Encoding: headers %v", w.Header())
+	}
+	if w := fetch("/small", "gzip"); w.Header().Get("Content-Encoding") != "" || w.Body.String() != "tiny" {
+		t.Fatal("responses under min_size should not be compressed")
+	}
+	if w := fetch("/image", "gzip"); w.Header().Get("Content-Encoding") != "" {
+		t.Fatal("image/png is not in the compressed types")
+	}
+}
+
+func TestCompressionEarlyHints(t *testing.T) {
+	page := strings.Repeat("hello world ", 200)
+	rules := &config.Compress{Enabled: true, Level: 6, MinSize: 100, Types: config.DefaultCompressTypes}
+	server := httptest.NewServer(compressHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Link", "</app.css>; rel=preload")
+		w.WriteHeader(http.StatusEarlyHints)
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(page))
+	}), rules))
+	defer server.Close()
+
+	hints := 0
+	trace := &httptrace.ClientTrace{Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+		if code == http.StatusEarlyHints && header.Get("Link") != "" {
+			hints++
+		}
+		return nil
+	}}
+	r, _ := http.NewRequest("GET", server.URL, nil)
+	r = r.WithContext(httptrace.WithClientTrace(r.Context(), trace))
+	r.Header.Set("Accept-Encoding", "gzip")
+	resp, err := http.DefaultTransport.RoundTrip(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if hints != 1 {
+		t.Errorf("got %d 103 responses, want 1", hints)
+	}
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Encoding") != "gzip" {
+		t.Fatalf("after the hints: got %d with headers %v", resp.StatusCode, resp.Header)
+	}
+}
+
+func TestPrecompressedStatic(t *testing.T) {
+	root, err := ioutil.TempDir("", "slashing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	ioutil.WriteFile(filepath.Join(root, "app.js"), []byte("plain"), 0644)
+	ioutil.WriteFile(filepath.Join(root, "app.js.gz"), []byte("gzipped"), 0644)
+	ioutil.WriteFile(filepath.Join(root, "app.js.br"), []byte("brotli"), 0644)
+
+	s := newTestServer(t, "domain=a.com:"+root)
+	fetch := func(acceptEncoding string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "https://a.com/app.js", nil)
+		r.Header.Set("Accept-Encoding", acceptEncoding)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
+	etags := map[string]bool{}
+	for acceptEncoding, want := range map[string]string{
+		"gzip, br":         "brotli",
+		"gzip, br;q=0.5":   "gzipped",
+		"gzip;q=0, br;q=0": "plain",
+		"":                 "plain",
+	} {
+		w := fetch(acceptEncoding)
+		if w.Body.String() != want {
+			t.Errorf("Accept-Encoding %q: got %q, want %q", acceptEncoding, w.Body.String(), want)
+		}
+		if !strings.HasPrefix(w.Header().Get("Content-Type"), "text/javascript") && !strings.HasPrefix(w.Header().Get("Content-Type"), "application/javascript") {
+			t.Errorf("Accept-Encoding %q: Content-Type %q", acceptEncoding, w.Header().Get("Content-Type"))
+		}
+		if w.Header().Get("Vary") != "Accept-Encoding" {
+			t.Errorf("Accept-Encoding %q: missing Vary", acceptEncoding)
+		}
+		etags[w.Header().Get("ETag")] = true
+	}
+	if len(etags) != 3 {
+		t.Error("each representation should have its own ETag, got", etags)
+	}
+
+	r := httptest.NewRequest("GET", "https://a.com/app.js", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	r.Header.Set("If-None-Match", fetch("gzip").Header().Get("ETag"))
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	if w.Code != http.StatusNotModified {
+		t.Error("matching ETag should give 304, got", w.Code)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	backend := backendServer("ok")
+	defer backend.Close()
+	cfg, err := config.Parse(strings.NewReader(`
+domain=a.com
+backend=` + hostOf(backend) + `
+rate_limit=1/m burst=2 key=header:X-Api-Key store=kv
+location=prefix /window/
+proxy=
+rate_limit=2/m algorithm=sliding_window
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	kv := hashmap.New()
+	s, err := New(cfg, kv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fetch := func(path, apiKey string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "https://a.com"+path, nil)
+		if apiKey != "" {
+			r.Header.Set("X-Api-Key", apiKey)
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
+
+	for i := 0; i < 2; i++ {
+		if w := fetch("/", "alice"); w.Code != http.StatusOK {
+			t.Fatalf("request %d within the burst got %d", i, w.Code)
+		}
+	}
+	w := fetch("/", "alice")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "60" {
+		t.Fatalf("expected 429 with Retry-After 60, got %d %q", w.Code, w.Header().Get("Retry-After"))
+	}
+	if w := fetch("/", "bob"); w.Code != http.StatusOK {
+		t.Fatal("another API key should have its own bucket, got", w.Code)
+	}
+	if _, ok := kv.Get(rateLimitPrefix + "a.com:header:alice"); !ok {
+		t.Fatal("token bucket should be kept in the embedded KV store")
+	}
+
+	for i := 0; i < 2; i++ {
+		if w := fetch("/window/", ""); w.Code != http.StatusOK {
+			t.Fatalf("request %d within the window got %d", i, w.Code)
+		}
+	}
+	if w := fetch("/window/", ""); w.Code != http.StatusTooManyRequests {
+		t.Fatal("third request in the window should be limited, got", w.Code)
+	}
+
+	//the previous window still counts in proportion to its overlap
+	limiter := &rateLimiter{rules: &config.RateLimit{Limit: 2, Period: time.Minute, Algorithm: config.RateLimitSlidingWindow}, store: newMemoryCounters()}
+	start := time.Unix(0, 0).Add(1000 * time.Minute)
+	limiter.allow("k", start)
+	limiter.allow("k", start)
+	if ok, _ := limiter.allow("k", start.Add(time.Minute+15*time.Second)); ok {
+		t.Fatal("the previous window weighs 1.5 requests 15s into the next one")
+	}
+	if ok, _ := limiter.allow("k", start.Add(time.Minute+45*time.Second)); !ok {
+		t.Fatal("the previous window weighs 0.5 requests 45s into the next one")
+	}
+}
+
+func TestRateLimitKVExpiry(t *testing.T) {
+	backend := backendServer("ok")
+	defer backend.Close()
+	cfg, err := config.Parse(strings.NewReader(`
+domain=a.com
+backend=` + hostOf(backend) + `
+rate_limit=10/s burst=1 key=header:X-Api-Key store=kv
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	kv := hashmap.New()
+	kv.Set(rateLimitPrefix+"a.com:header:legacy", []byte("1.000000 1"))
+	s, err := New(cfg, kv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fetch := func(apiKey string) {
+		r := httptest.NewRequest("GET", "https://a.com/", nil)
+		r.Header.Set("X-Api-Key", apiKey)
+		s.ServeHTTP(httptest.NewRecorder(), r)
+	}
+	rateLimitKeys := func() []string {
+		keys := []string{}
+		for _, k := range kv.Keys() {
+			if key := k.(string); strings.HasPrefix(key, rateLimitPrefix) {
+				keys = append(keys, key)
+			}
+		}
+		return keys
+	}
+	if keys := rateLimitKeys(); len(keys) != 0 {
+		t.Fatalf("counters without an expiry should be swept at startup, got %q", keys)
+	}
+	for _, apiKey := range []string{"a", "b", "c"} {
+		fetch(apiKey)
+	}
+	if keys := rateLimitKeys(); len(keys) != 3 {
+		t.Fatalf("expected a bucket per API key, got %q", keys)
+	}
+
+	//a full bucket is the same as none, after 100ms at 10/s
+	time.Sleep(150 * time.Millisecond)
+	if s.kvCounters.get(rateLimitPrefix+"a.com:header:a") != nil {
+		t.Fatal("an expired bucket should not be read")
+	}
+	s.kvCounters.mu.Lock()
+	s.kvCounters.lastSweep = time.Time{}
+	s.kvCounters.mu.Unlock()
+	fetch("d")
+	if keys := rateLimitKeys(); len(keys) != 1 || keys[0] != rateLimitPrefix+"a.com:header:d" {
+		t.Fatalf("idle buckets should be swept, got %q", keys)
+	}
+}
+
+func TestConnectionLimit(t *testing.T) {
+	s := newTestServer(t, "max_conns_per_ip=1\n")
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	limited := s.LimitConns(ln)
+	defer limited.Close()
+
+	dial := func() net.Conn {
+		client, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		client.Write([]byte("x"))
+		return client
+	}
+	accept := func() (net.Conn, error) {
+		conn, err := limited.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = conn.Read(make([]byte, 1))
+		return conn, err
+	}
+
+	first := dial()
+	defer first.Close()
+	served, err := accept()
+	if err != nil {
+		t.Fatal("first connection refused:", err)
+	}
+	second := dial()
+	defer second.Close()
+	if refused, err := accept(); err != errTooManyConns {
+		t.Fatal("second connection from the same IP should be refused, got", err)
+	} else {
+		refused.Close()
+	}
+	served.Close()
+	third := dial()
+	defer third.Close()
+	if conn, err := accept(); err != nil {
+		t.Fatal("connection after a close refused:", err)
+	} else {
+		conn.Close()
+	}
+	if counts := limited.(*connLimiter).conns; len(counts) != 0 {
+		t.Fatal("every close should release its count, left", counts)
+	}
+
+	//trusted proxies are neither counted nor released
+	s = newTestServer(t, "max_conns_per_ip=1\ntrusted_proxies=127.0.0.0/8\n")
+	ln, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	limited = s.LimitConns(ln)
+	defer limited.Close()
+	limiter := limited.(*connLimiter)
+	limiter.conns["127.0.0.1"] = 1 //a count the trusted connections must leave alone
+	for i := 0; i < 2; i++ {
+		client := dial()
+		defer client.Close()
+		conn, err := accept()
+		if err != nil {
+			t.Fatal("trusted proxy refused:", err)
+		}
+		conn.Close()
+	}
+	if limiter.conns["127.0.0.1"] != 1 {
+		t.Fatal("a trusted connection changed the count:", limiter.conns)
+	}
+}
+
+func TestHtpasswdDummyCost(t *testing.T) {
+	cheap, _ := bcrypt.GenerateFromPassword([]byte("a"), bcrypt.MinCost)
+	dear, _ := bcrypt.GenerateFromPassword([]byte("b"), bcrypt.MinCost+2)
+	table, err := parseHtpasswd([]byte("a:" + string(cheap) + "\nb:" + string(dear) + "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	//unknown users must take as long as the slowest known one
+	if cost, err := bcrypt.Cost(table.(*htpasswd).dummy); err != nil || cost != bcrypt.MinCost+2 {
+		t.Fatalf("expected a dummy hash of cost %d, got %d %v", bcrypt.MinCost+2, cost, err)
+	}
+}
+
+func TestAuth(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("user=" + r.Header.Get("X-User")))
+	}))
+	defer backend.Close()
+	sso := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Cookie") != "session=good" {
+			http.Redirect(w, r, "https://sso.example/login?rd="+r.Header.Get("X-Forwarded-Uri"), http.StatusFound)
+			return
+		}
+		w.Header().Set("X-User", "alice")
+	}))
+	defer sso.Close()
+	root, err := ioutil.TempDir("", "slashing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	hash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	ioutil.WriteFile(filepath.Join(root, "htpasswd"), []byte("# admins\nadmin:"+string(hash)+"\n"), 0600)
+	ioutil.WriteFile(filepath.Join(root, "jwks.json"), []byte(`{"keys":[{"kty":"oct","kid":"k1","k":"c2VjcmV0LWtleQ"}]}`), 0600)
+
+	s := newTestServer(t, `
+domain=a.com
+backend=`+hostOf(backend)+`
+location=prefix /admin/
+proxy=
+auth=basic file=`+filepath.Join(root, "htpasswd")+` realm=Admin
+location=prefix /api/
+proxy=
+auth=jwt jwks=`+filepath.Join(root, "jwks.json")+` issuer=https://issuer.example
+location=prefix /app/
+proxy=
+auth=forward url=`+sso.URL+`/verify copy=X-User
+`)
+	fetch := func(path string, header ...string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "https://a.com"+path, nil)
+		for i := 0; i < len(header); i += 2 {
+			r.Header.Set(header[i], header[i+1])
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
+	token := func(claims string) string {
+		signed := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","kid":"k1"}`)) + "." + base64.RawURLEncoding.EncodeToString([]byte(claims))
+		mac := hmac.New(sha256.New, []byte("secret-key"))
+		mac.Write([]byte(signed))
+		return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+	}
+
+	if w := fetch("/admin/"); w.Code != http.StatusUnauthorized || !strings.Contains(w.Header().Get("WWW-Authenticate"), `realm="Admin"`) {
+		t.Fatalf("expected a basic challenge, got %d %v", w.Code, w.Header())
+	}
+	basic := "Basic " + base64.StdEncoding.EncodeToString([]byte("admin:secret"))
+	if w := fetch("/admin/", "Authorization", basic); w.Code != http.StatusOK {
+		t.Fatal("right password refused:", w.Code)
+	}
+	wrong := "Basic " + base64.StdEncoding.EncodeToString([]byte("admin:guess"))
+	if w := fetch("/admin/", "Authorization", wrong); w.Code != http.StatusUnauthorized {
+		t.Fatal("wrong password accepted:", w.Code)
+	}
+	unknown := "Basic " + base64.StdEncoding.EncodeToString([]byte("nobody:no such user"))
+	if w := fetch("/admin/", "Authorization", unknown); w.Code != http.StatusUnauthorized {
+		t.Fatal("unknown user accepted with the password of the dummy hash:", w.Code)
+	}
+
+	exp := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+	if w := fetch("/api/", "Authorization", "Bearer "+token(`{"iss":"https://issuer.example","exp":`+exp+`}`)); w.Code != http.StatusOK {
+		t.Fatal("valid token refused:", w.Code, w.Header())
+	}
+	for name, claims := range map[string]string{
+		"expired":      `{"iss":"https://issuer.example","exp":1000}`,
+		"wrong issuer": `{"iss":"https://evil.example","exp":` + exp + `}`,
+	} {
+		if w := fetch("/api/", "Authorization", "Bearer "+token(claims)); w.Code != http.StatusUnauthorized {
+			t.Errorf("%s token accepted: %d", name, w.Code)
+		}
+	}
+	if w := fetch("/api/", "Authorization", "Bearer "+token(`{"iss":"https://issuer.example"}`)+"x"); w.Code != http.StatusUnauthorized {
+		t.Fatal("tampered token accepted:", w.Code)
+	}
+
+	if w := fetch("/app/page?x=1"); w.Code != http.StatusFound || w.Header().Get("Location") != "https://sso.example/login?rd=/app/page?x=1" {
+		t.Fatalf("expected the auth service's redirect, got %d %v", w.Code, w.Header())
+	}
+	if w := fetch("/app/", "Cookie", "session=good", "X-User", "mallory"); w.Code != http.StatusOK || w.Body.String() != "user=alice" {
+		t.Fatalf("expected the user from the auth service, got %d %q", w.Code, w.Body.String())
+	}
+}
+
+func TestRewrites(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.RequestURI()))
+	}))
+	defer backend.Close()
+	s := newTestServer(t, `
+domain=www.a.com
+backend=`+hostOf(backend)+`
+canonical_host=apex
+trailing_slash=remove
+rewrite=^/old/(.*)$ /new/$1
+rewrite=^/new/(\d+)$ /item?id=$1
+rewrite=^/blog/(.*)$ https://blog.a.com/$1 code=302
+`)
+
+	add := newTestServer(t, `
+domain=a.com
+backend=`+hostOf(backend)+`
+trailing_slash=add
+`)
+	for _, c := range []struct {
+		server         *Server
+		method, target string
+		code           int
+		location       string
+	}{
+		{s, "GET", "https://www.a.com/page?q=1", 301, "https://a.com/page?q=1"},
+		{s, "POST", "https://www.a.com/form", 308, "https://a.com/form"},
+		{s, "GET", "https://a.com/dir/?q=1", 301, "/dir?q=1"},
+		{s, "GET", "https://a.com/blog/post", 302, "https://blog.a.com/post"},
+		{s, "GET", "https://a.com//evil.com/", 301, "/evil.com"},
+		{s, "GET", "https://a.com/%5Cevil.com/", 301, "/evil.com"},
+		{add, "GET", "https://a.com//evil.com/x", 301, "/evil.com/x/"},
+		{add, "GET", "https://a.com/%2F%2Fevil.com%2Fx", 301, "/evil.com/x/"},
+		{add, "GET", "https://a.com//evil", 301, "/evil/"},
+	} {
+		w := httptest.NewRecorder()
+		c.server.ServeHTTP(w, httptest.NewRequest(c.method, c.target, nil))
+		if w.Code != c.code || w.Header().Get("Location") != c.location {
+			t.Errorf("%s %s: expected %d to %s, got %d to %s", c.method, c.target, c.code, c.location, w.Code, w.Header().Get("Location"))
+		}
+	}
+	if _, body := get(s, "https://a.com/old/42?lang=en"); body != "/item?id=42&lang=en" {
+		t.Fatal("rewrites should chain and keep the query, backend got", body)
+	}
+	if _, body := get(s, "https://a.com/old/x"); body != "/new/x" {
+		t.Fatal("expected /new/x, backend got", body)
+	}
+	if domains := s.Domains(); len(domains) != 2 || domains[0] != "a.com" || domains[1] != "www.a.com" {
+		t.Fatal("both names should get certificates, got", domains)
+	}
+}
+
+func TestHeaderRules(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Server", "Apache")
+		w.Header().Set("X-Powered-By", "PHP/7.4")
+		w.Write([]byte(r.Header.Get("X-Tenant") + " " + r.Header.Get("X-Client") + " " + r.Header.Get("Cookie")))
+	}))
+	defer backend.Close()
+	s := newTestServer(t, `
+domain=a.com
+backend=`+hostOf(backend)+`
+response_header=set Strict-Transport-Security max-age=15768000; includeSubDomains
+response_header=remove Server
+response_header=remove X-Powered-By
+response_header=set X-Request-ID $request_id
+request_header=set X-Tenant acme@$host
+location=prefix /api/
+proxy=
+request_header=set X-Client $client_ip
+request_header=remove Cookie
+`)
+	r := httptest.NewRequest("GET", "https://a.com/api/", nil)
+	r.Header.Set("Cookie", "session=1")
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	if w.Body.String() != "acme@a.com 192.0.2.1 " {
+		t.Fatalf("backend got the wrong headers: %q", w.Body.String())
+	}
+	header := w.Header()
+	if header.Get("Strict-Transport-Security") != "max-age=15768000; includeSubDomains" || header.Get("Server") != "" || header.Get("X-Powered-By") != "" {
+		t.Fatalf("response headers not rewritten: %v", header)
+	}
+	if len(header.Get("X-Request-ID")) != 32 {
+		t.Fatal("expected a generated request ID, got", header.Get("X-Request-ID"))
+	}
+
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "https://a.com/missing-upstream-path", nil))
+	if w.Header().Get("Strict-Transport-Security") == "" {
+		t.Fatal("domain rules should apply outside the locations too")
+	}
+}
+
+func TestCanarySplit(t *testing.T) {
+	stable, canary := backendServer("stable"), backendServer("canary")
+	defer stable.Close()
+	defer canary.Close()
+	s := newTestServer(t, `
+upstream=canary
+backend=`+hostOf(canary)+`
+domain=a.com
+backend=`+hostOf(stable)+`
+split=canary 0 header=X-Canary cookie=canary
+`)
+	fetch := func(header, value string) string {
+		r := httptest.NewRequest("GET", "https://a.com/", nil)
+		if header != "" {
+			r.Header.Set(header, value)
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w.Body.String()
+	}
+
+	if body := fetch("", ""); body != "stable" {
+		t.Fatal("0% should stay on the stable pool, got", body)
+	}
+	if body := fetch("X-Canary", "always"); body != "canary" {
+		t.Fatal("the header should force the canary, got", body)
+	}
+
+	admin := s.AdminHandler()
+	w := httptest.NewRecorder()
+	admin.ServeHTTP(w, httptest.NewRequest("POST", "/splits?pool=canary&percent=100", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"percent":100`) {
+		t.Fatalf("admin API did not change the split: %d %s", w.Code, w.Body.String())
+	}
+	if body := fetch("", ""); body != "canary" {
+		t.Fatal("100% should go to the canary, got", body)
+	}
+	if body := fetch("Cookie", "canary=never"); body != "stable" {
+		t.Fatal("the cookie should keep a tester on the stable pool, got", body)
+	}
+
+	w = httptest.NewRecorder()
+	admin.ServeHTTP(w, httptest.NewRequest("POST", "/splits?pool=stable&percent=5", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatal("unknown split pool should be 404, got", w.Code)
+	}
+}
+
+func TestMirror(t *testing.T) {
+	primary := backendServer("primary")
+	defer primary.Close()
+	shadowBodies := make(chan string, 10)
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		shadowBodies <- r.Method + " " + r.Host + " " + string(body)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("shadow"))
+	}))
+	defer shadow.Close()
+	s := newTestServer(t, `
+upstream=shadow
+backend=`+hostOf(shadow)+`
+domain=a.com
+backend=`+hostOf(primary)+`
+mirror=shadow sample=100 max_body=16
+`)
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("POST", "https://a.com/orders", strings.NewReader("order=1")))
+	if w.Code != http.StatusOK || w.Body.String() != "primary" {
+		t.Fatalf("the client should only see the primary answer, got %d %q", w.Code, w.Body.String())
+	}
+	select {
+	case got := <-shadowBodies:
+		if got != "POST a.com order=1" {
+			t.Fatal("shadow got", got)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("the request was not mirrored")
+	}
+
+	//a body over max_body reaches the primary whole and is not mirrored
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("POST", "https://a.com/orders", strings.NewReader(strings.Repeat("x", 100))))
+	if w.Code != http.StatusOK {
+		t.Fatal("large body request failed:", w.Code)
+	}
+
+	var stats []mirrorStatus
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		w = httptest.NewRecorder()
+		s.AdminHandler().ServeHTTP(w, httptest.NewRequest("GET", "/mirrors", nil))
+		stats = nil
+		json.Unmarshal(w.Body.Bytes(), &stats)
+		if len(stats) == 1 && stats[0].StatusMismatches == 1 {
+			break
+		}
+	}
+	if len(stats) != 1 || stats[0].Pool != "shadow" || stats[0].Mirrored != 1 || stats[0].Dropped != 1 || stats[0].StatusMismatches != 1 {
+		t.Fatalf("unexpected mirror counters: %+v", stats)
+	}
+}
+
+func TestMirrorBreaker(t *testing.T) {
+	primary := backendServer("primary")
+	defer primary.Close()
+	var failing int32 = 1
+	shadowed := make(chan int, 10)
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status := http.StatusOK
+		if atomic.LoadInt32(&failing) == 1 {
+			status = http.StatusInternalServerError
+		}
+		w.WriteHeader(status)
+		shadowed <- status
+	}))
+	defer shadow.Close()
+	s := newTestServer(t, `
+upstream=shadow
+backend=`+hostOf(shadow)+`
+circuit_breaker=max_fails=1 window=1m cooldown=50ms half_open=1
+domain=a.com
+backend=`+hostOf(primary)+`
+mirror=shadow
+`)
+	backend := s.pools["shadow"].Backends[0]
+	mirrored := func() int {
+		get(s, "https://a.com/")
+		select {
+		case status := <-shadowed:
+			return status
+		case <-time.After(2 * time.Second):
+			return 0
+		}
+	}
+	waitIdle := func() {
+		//the breaker hears of the answer right after the shadow sent it
+		for deadline := time.Now().Add(2 * time.Second); atomic.LoadInt64(&backend.active) > 0 && time.Now().Before(deadline); {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	if mirrored() != http.StatusInternalServerError {
+		t.Fatal("the failing shadow did not get the copy")
+	}
+	waitIdle()
+	if backend.breaker.ready() {
+		t.Fatal("shadow failures should open the breaker of the shadow pool")
+	}
+	atomic.StoreInt32(&failing, 0)
+	time.Sleep(60 * time.Millisecond)
+	//the trial succeeds and closes the breaker, so the copies keep flowing
+	for i := 0; i < 3; i++ {
+		if mirrored() != http.StatusOK {
+			t.Fatalf("copy %d did not reach the recovered shadow", i)
+		}
+		waitIdle()
+	}
+}
+
+// writeCertificate writes a self-signed certificate for name and its key
+// into dir.
+func writeCertificate(t *testing.T, dir, name string) (string, string) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: name}, DNSNames: []string{name}, NotAfter: time.Now().Add(time.Hour)}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	certFile, keyFile := filepath.Join(dir, name+".pem"), filepath.Join(dir, name+".key")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	return certFile, keyFile
+}
+
+func TestHTTPSBackend(t *testing.T) {
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client := "anonymous"
+		if len(r.TLS.PeerCertificates) > 0 {
+			client = r.TLS.PeerCertificates[0].Subject.CommonName
+		}
+		w.Write([]byte(r.TLS.ServerName + " " + client))
+	}))
+	backend.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	backend.StartTLS()
+	defer backend.Close()
+
+	root, err := ioutil.TempDir("", "slashing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	caFile := filepath.Join(root, "ca.pem")
+	ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: backend.Certificate().Raw}), 0600)
+	certFile, keyFile := writeCertificate(t, root, "slashing")
+
+	s := newTestServer(t, `
+domain=a.com
+backend=https://`+hostOf(backend)+`
+tls=ca=`+caFile+` server_name=example.com cert=`+certFile+` key=`+keyFile+`
+`)
+	if code, body := get(s, "https://a.com/"); code != http.StatusOK || body != "example.com slashing" {
+		t.Fatalf("expected SNI example.com and the client certificate, got %d %q", code, body)
+	}
+
+	s = newTestServer(t, `
+domain=a.com
+backend=https://`+hostOf(backend)+`
+tls=server_name=example.com
+`)
+	if code, _ := get(s, "https://a.com/"); code != http.StatusBadGateway {
+		t.Fatal("a backend signed by an unknown CA should fail, got", code)
+	}
+}
+
+func TestFastCGI(t *testing.T) {
+	root, err := ioutil.TempDir("", "slashing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	os.Mkdir(filepath.Join(root, "admin"), 0755)
+	for _, name := range []string{"index.php", "app.php", "admin/index.php", "style.css"} {
+		ioutil.WriteFile(filepath.Join(root, name), []byte("<?php source of "+name), 0644)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go fcgi.Serve(ln, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		env := fcgi.ProcessEnv(r)
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(strings.TrimPrefix(env["SCRIPT_FILENAME"], root) + " " + strings.TrimPrefix(env["PATH_TRANSLATED"], root) + " " + r.URL.RequestURI() + " " + env["APP_ENV"] + " " + string(body)))
+	}))
+
+	s := newTestServer(t, `
+domain=a.com:`+root+`
+backend=fastcgi://`+ln.Addr().String()+`
+fastcgi=index=index.php APP_ENV=test
+`)
+	for target, expected := range map[string]string{
+		"/":                "/index.php  / test ",
+		"/app.php/user/42": "/app.php /user/42 /app.php/user/42 test ",
+		"/admin/":          "/admin/index.php  /admin/ test ",
+		"/blog/hello?p=1":  "/index.php  /blog/hello?p=1 test ",
+		"/style.css":       "<?php source of style.css",
+	} {
+		if code, body := get(s, "https://a.com"+target); code != http.StatusOK || body != expected {
+			t.Errorf("%s: expected %q, got %d %q", target, expected, code, body)
+		}
+	}
+	if code, _ := get(s, "https://a.com/missing.php"); code != http.StatusNotFound {
+		t.Fatal("a missing script should be 404, got", code)
+	}
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("POST", "https://a.com/app.php", strings.NewReader("name=x")))
+	if w.Body.String() != "/app.php  /app.php test name=x" {
+		t.Fatalf("POST body not passed to the script: %q", w.Body.String())
+	}
+}
+
+func TestGRPCBackend(t *testing.T) {
+	serving := true
+	mux := http.NewServeMux()
+	mux.HandleFunc("/echo.Echo/Stream", func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 {
+			t.Errorf("backend got %s, expected HTTP/2", r.Proto)
+		}
+		w.Header().Set("Content-Type", "application/grpc")
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		//echo every message as soon as it arrives
+		for {
+			frame := make([]byte, 5)
+			if _, err := io.ReadFull(r.Body, frame); err != nil {
+				break
+			}
+			message := make([]byte, binary.BigEndian.Uint32(frame[1:]))
+			io.ReadFull(r.Body, message)
+			w.Write(append(frame, message...))
+			w.(http.Flusher).Flush()
+		}
+		w.Header().Set(http.TrailerPrefix+"Grpc-Status", "0")
+	})
+	mux.HandleFunc("/echo.Echo/Missing", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Grpc-Status", "5")
+		w.Header().Set("Grpc-Message", "no such echo")
+	})
+	mux.HandleFunc("/grpc.health.v1.Health/Check", func(w http.ResponseWriter, r *http.Request) {
+		request, _ := ioutil.ReadAll(r.Body)
+		if string(request[5:]) != "\x0a\x04echo" {
+			t.Errorf("unexpected health check request %q", request)
+		}
+		status := byte(2) //NOT_SERVING
+		if serving {
+			status = 1
+		}
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.Write([]byte{0, 0, 0, 0, 2, 0x08, status})
+		w.Header().Set("Grpc-Status", "0")
+	})
+	backend := httptest.NewServer(h2c.NewHandler(mux, &http2.Server{}))
+	defer backend.Close()
+
+	s := newTestServer(t, `
+domain=a.com
+backend=h2c://`+hostOf(backend)+`
+health_check=grpc service=echo interval=1h rise=1 fall=1
+`)
+	defer s.Shutdown(context.Background())
+	front := httptest.NewUnstartedServer(s)
+	front.EnableHTTP2 = true
+	front.StartTLS()
+	defer front.Close()
+
+	call := func(method string, body io.Reader) *http.Response {
+		req, _ := http.NewRequest("POST", front.URL+method, body)
+		req.Host = "a.com"
+		req.Header.Set("Content-Type", "application/grpc")
+		req.Header.Set("TE", "trailers")
+		resp, err := front.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	stream, send := io.Pipe()
+	resp := call("/echo.Echo/Stream", stream)
+	for _, message := range []string{"ping", "pong"} {
+		//the next message is only sent once the previous one came back
+		frame := []byte{0, 0, 0, 0, byte(len(message))}
+		send.Write(append(frame, message...))
+		echo := make([]byte, 5+len(message))
+		if _, err := io.ReadFull(resp.Body, echo); err != nil || string(echo[5:]) != message {
+			t.Fatalf("expected the echo of %q, got %q %v", message, echo, err)
+		}
+	}
+	send.Close()
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if status := resp.Trailer.Get("Grpc-Status"); status != "0" {
+		t.Fatalf("expected grpc-status 0 in the trailers, got %q", status)
+	}
+
+	resp = call("/echo.Echo/Missing", http.NoBody)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Grpc-Status") != "5" || resp.Header.Get("Grpc-Message") != "no such echo" {
+		t.Fatalf("gRPC status not passed through: %d %v", resp.StatusCode, resp.Header)
+	}
+
+	pool := s.pools["a.com"]
+	checker := &healthChecker{pool: pool, backend: pool.Backends[0], check: pool.check, client: &http.Client{Transport: pool.transport}}
+	if err := checker.probe(); err != nil {
+		t.Fatal("serving backend failed its health check:", err)
+	}
+	serving = false
+	checker.observe(checker.probe())
+	if pool.Backends[0].Healthy() {
+		t.Fatal("NOT_SERVING backend still in rotation")
+	}
+	resp = call("/echo.Echo/Stream", http.NoBody)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Grpc-Status") != "14" {
+		t.Fatalf("expected UNAVAILABLE without a backend, got %d %v", resp.StatusCode, resp.Header)
+	}
+}
+
+func TestUnixSocketBackend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "slashing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ln, err := net.Listen("unix", filepath.Join(dir, "app.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := &httptest.Server{Listener: ln, Config: &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Host + r.URL.Path))
+	})}}
+	backend.Start()
+	defer backend.Close()
+
+	s := newTestServer(t, `
+domain=a.com
+backend=unix:`+filepath.Join(dir, "app.sock")+`
+health_check=/healthz interval=1h
+`)
+	defer s.Shutdown(context.Background())
+	if code, body := get(s, "https://a.com/hello"); code != http.StatusOK || body != "a.com/hello" {
+		t.Fatalf("expected the socket backend to answer, got %d %q", code, body)
+	}
+	pool := s.pools["a.com"]
+	checker := &healthChecker{pool: pool, backend: pool.Backends[0], check: pool.check, client: &http.Client{Transport: pool.transport}}
+	resp, err := checker.get()
+	if err != nil {
+		t.Fatal("health check of a socket backend failed:", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "localhost/healthz" {
+		t.Fatalf("unexpected health check request %q", body)
+	}
+}
+
+// echoServer answers every TCP connection, once the client is done
+// writing, with name and what the client wrote.
+func TestUpgrade(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "websocket" {
+			http.Error(w, "upgrade required", http.StatusUpgradeRequired)
+			return
+		}
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		rw.Flush()
+		line, _ := rw.ReadString('\n')
+		rw.WriteString("echo: " + line)
+		rw.Flush()
+	}))
+	defer backend.Close()
+
+	for _, rules := range []string{
+		"response_header=set X-Test yes",
+		"compress=on",
+	} {
+		s := newTestServer(t, `
+domain=a.com
+backend=`+hostOf(backend)+`
+`+rules+`
+`)
+		front := httptest.NewServer(s)
+		conn, err := net.Dial("tcp", front.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		conn.Write([]byte("GET /socket HTTP/1.1\r\nHost: a.com\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n"))
+		br := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil || resp.StatusCode != http.StatusSwitchingProtocols {
+			t.Fatalf("%s: expected the upgrade to go through, got %v %v", rules, resp, err)
+		}
+		if strings.HasPrefix(rules, "response_header") && resp.Header.Get("X-Test") != "yes" {
+			t.Errorf("%s: the rules should apply to the 101 response, got %v", rules, resp.Header)
+		}
+		conn.Write([]byte("hello\n"))
+		if line, _ := br.ReadString('\n'); line != "echo: hello\n" {
+			t.Errorf("%s: expected the echo over the upgraded connection, got %q", rules, line)
+		}
+		conn.Close()
+		front.Close()
+		s.Shutdown(context.Background())
+	}
+}
+
+func echoServer(t *testing.T, name string) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				data, _ := ioutil.ReadAll(conn)
+				conn.Write([]byte(name + ": " + string(data)))
+			}()
+		}
+	}()
+	return ln
+}
+
+// talk writes message to conn, closes its writing side and returns the
+// answer.
+func talk(t *testing.T, conn net.Conn, message string) string {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte(message))
+	conn.(interface{ CloseWrite() error }).CloseWrite()
+	answer, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(answer)
+}
+
+func TestTCPStream(t *testing.T) {
+	echo := echoServer(t, "echo")
+	defer echo.Close()
+	//listen before closing the dead port, so the listener cannot reuse it
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer ln.Close()
+	dead, _ := net.Listen("tcp", "127.0.0.1:0")
+	dead.Close()
+
+	s := newTestServer(t, `
+upstream=db
+backend=`+dead.Addr().String()+`
+backend=`+echo.Addr().String()+`
+health_check=tcp interval=1h rise=1 fall=1
+stream=tcp 127.0.0.1:0 upstream=db
+`)
+	defer s.Shutdown(context.Background())
+	go s.Streams()[0].Serve(ln)
+
+	for i := 0; i < 2; i++ {
+		//the unreachable backend is skipped
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if answer := talk(t, conn, "hello"); answer != "echo: hello" {
+			t.Fatalf("expected the echo backend to answer, got %q", answer)
+		}
+	}
+
+	pool := s.pools["db"]
+	checker := &healthChecker{pool: pool, backend: pool.Backends[0], check: pool.check}
+	checker.observe(checker.probe())
+	if pool.Backends[0].Healthy() {
+		t.Fatal("closed port passed the tcp health check")
+	}
+	checker.backend = pool.Backends[1]
+	if err := checker.probe(); err != nil {
+		t.Fatal("open port failed the tcp health check:", err)
+	}
+}
+
+func TestSNIStream(t *testing.T) {
+	root, err := ioutil.TempDir("", "slashing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	certFile, keyFile := writeCertificate(t, root, "a.com")
+	git := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("git " + r.TLS.ServerName))
+	}))
+	defer git.Close()
+	echo := echoServer(t, "echo")
+	defer echo.Close()
+
+	s := newTestServer(t, `
+upstream=git
+backend=`+hostOf(git)+`
+upstream=echo
+backend=`+echo.Addr().String()+`
+stream=tcp :443 sni=git.a.com upstream=git
+stream=tcp :443 sni=*.tls.a.com upstream=echo cert=`+certFile+` key=`+keyFile+`
+`)
+	defer s.Shutdown(context.Background())
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	shared := s.ShareTLS(ln)
+	defer shared.Close()
+	https := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("https " + r.TLS.ServerName))
+	})}
+	go https.ServeTLS(shared, certFile, keyFile)
+
+	for serverName, expected := range map[string]string{"git.a.com": "git git.a.com", "www.a.com": "https www.a.com", "": "https ", ".tls.a.com": "https .tls.a.com"} {
+		client := &http.Client{Timeout: 5 * time.Second, Transport: &http.Transport{TLSClientConfig: &tls.Config{ServerName: serverName, InsecureSkipVerify: true}}}
+		resp, err := client.Get("https://" + ln.Addr().String() + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != expected {
+			t.Errorf("SNI %q: expected %q, got %q", serverName, expected, body)
+		}
+	}
+
+	conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{ServerName: "x.tls.a.com", InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn.ConnectionState().PeerCertificates[0].Subject.CommonName != "a.com" {
+		t.Fatal("TLS was not terminated with the certificate of the route")
+	}
+	if answer := talk(t, conn, "hello"); answer != "echo: hello" {
+		t.Fatalf("expected the plain backend to answer, got %q", answer)
+	}
+}
+
+func TestUDPStream(t *testing.T) {
+	backend, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := backend.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			backend.WriteTo(append([]byte("pong "), buf[:n]...), addr)
+		}
+	}()
+
+	s := newTestServer(t, `
+upstream=dns
+backend=`+backend.LocalAddr().String()+`
+stream=udp 127.0.0.1:0 upstream=dns timeout=1s
+`)
+	defer s.Shutdown(context.Background())
+	front, _ := net.ListenPacket("udp", "127.0.0.1:0")
+	defer front.Close()
+	go s.Streams()[0].ServePacket(front)
+
+	conn, err := net.Dial("udp", front.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	for i, message := range []string{"one", "two", "three"} {
+		if i == 2 {
+			//past the timeout, the session is gone and a new one opens
+			time.Sleep(1500 * time.Millisecond)
+		}
+		conn.Write([]byte(message))
+		buf := make([]byte, 1500)
+		n, err := conn.Read(buf)
+		if err != nil || string(buf[:n]) != "pong "+message {
+			t.Fatalf("expected the answer to %q, got %q %v", message, buf[:n], err)
+		}
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "slashing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	backend := backendServer("hello")
+	defer backend.Close()
+	s := newTestServer(t, `
+access_log=`+filepath.Join(dir, "access.log")+`
+domain=a.com
+backend=http://`+hostOf(backend)+`
+domain=b.com
+backend=http://`+hostOf(backend)+`
+access_log=`+filepath.Join(dir, "b.log")+` format=json
+domain=c.com
+access_log=off
+location=prefix /
+respond=204
+`)
+	defer s.Shutdown(context.Background())
+
+	r := httptest.NewRequest("GET", "https://a.com/page?q=1", nil)
+	r.Header.Set("User-Agent", `curl "7"`)
+	s.ServeHTTP(httptest.NewRecorder(), r)
+	get(s, "https://unknown.com/")
+	get(s, "https://b.com/json")
+	get(s, "https://c.com/")
+
+	combined, _ := ioutil.ReadFile(filepath.Join(dir, "access.log"))
+	lines := strings.Split(strings.TrimSpace(string(combined)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected a.com and the unknown host in the default log, got %q", combined)
+	}
+	pattern := `^192\.0\.2\.1 - - \[[^]]+\] "GET https://a\.com/page\?q=1 HTTP/1\.1" 200 5 "-" "curl \\"7\\"" [0-9.]+ ` +
+		regexp.QuoteMeta(hostOf(backend)) + ` [0-9.]+$`
+	if !regexp.MustCompile(pattern).MatchString(lines[0]) {
+		t.Errorf("unexpected combined line %q", lines[0])
+	}
+	if !strings.Contains(lines[1], `"GET https://unknown.com/ HTTP/1.1" 404 `) || !strings.HasSuffix(lines[1], " - -") {
+		t.Errorf("unexpected line of an unknown host %q", lines[1])
+	}
+
+	data, _ := ioutil.ReadFile(filepath.Join(dir, "b.log"))
+	var entry accessLogEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		t.Fatalf("expected one JSON line, got %q: %v", data, err)
+	}
+	if entry.Host != "b.com" || entry.URI != "https://b.com/json" || entry.Status != 200 || entry.Bytes != 5 ||
+		entry.Upstream != hostOf(backend) || entry.RequestID == "" {
+		t.Errorf("unexpected JSON entry %+v", entry)
+	}
+}
+
+func TestAccessLogRevalidation(t *testing.T) {
+	entries := make(chan *logEntry, 2)
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entry, _ := r.Context().Value(logEntryKey).(*logEntry)
+		entries <- entry
+		w.Header().Set("Cache-Control", "max-age=0, stale-while-revalidate=60")
+		w.Write([]byte("page"))
+	})
+	handler := cache.New(cache.NewMemoryStore(1<<20)).Handler(ownLogEntry(upstream), &config.Cache{Enabled: true, MaxObject: 1 << 20})
+	r, entry := withLogEntry(httptest.NewRequest("GET", "https://a.com/", nil))
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+	if <-entries != entry {
+		t.Fatal("a miss should fill in the log entry of its request")
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Header().Get("X-Cache") != "STALE" {
+		t.Fatal("expected a stale response revalidated in the background, got", w.Header().Get("X-Cache"))
+	}
+	//the line of the stale response may be written before the revalidation ends
+	if background := <-entries; background == nil || background == entry {
+		t.Fatal("the revalidation should have a log entry of its own")
+	}
+}
+
+func TestAccessLogOff(t *testing.T) {
+	s := newTestServer(t, `
+domain=quiet.com
+access_log=off
+location=prefix /
+respond=204
+domain=plain.com
+location=prefix /
+respond=204
+`)
+	defer s.Shutdown(context.Background())
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	defer log.SetOutput(os.Stderr)
+
+	get(s, "https://quiet.com/secret")
+	get(s, "https://plain.com/page")
+	if strings.Contains(out.String(), "/secret") {
+		t.Errorf("a domain with access_log=off should not be logged, got %q", out.String())
+	}
+	if !strings.Contains(out.String(), "Incoming HTTP: 192.0.2.1 plain.com /page") {
+		t.Errorf("without an access log requests go to the process log, got %q", out.String())
+	}
+}
+
+func TestAccessLogRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "slashing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "access.log")
+	unrelated := []string{path + ".bak", path + ".old.gz", path + ".20200101-000000.gz"}
+	for _, name := range unrelated {
+		ioutil.WriteFile(name, []byte("keep me"), 0644)
+	}
+	s := newTestServer(t, `
+access_log=`+path+` max_size=200 keep=2
+domain=a.com
+location=prefix /
+respond=200 ok
+`)
+	defer s.Shutdown(context.Background())
+
+	for i := 0; i < 6; i++ {
+		get(s, "https://a.com/")
+	}
+	var rotated []string
+	files, _ := ioutil.ReadDir(dir)
+	for _, info := range files {
+		if rotatedSuffix.MatchString(strings.TrimPrefix(info.Name(), "access.log")) {
+			rotated = append(rotated, info.Name())
+		}
+	}
+	if len(rotated) != 2 {
+		t.Errorf("expected 2 rotated files kept, got %v", rotated)
+	}
+	for _, name := range unrelated {
+		if !fileExists(name) {
+			t.Errorf("%s is not a rotated log and should not be pruned", name)
+		}
+	}
+	if info, err := os.Stat(path); err != nil || info.Size() > 200 {
+		t.Errorf("expected the current log under max_size, got %v %v", info, err)
+	}
+
+	//as logrotate does
+	os.Rename(path, filepath.Join(dir, "moved"))
+	s.ReopenLogs()
+	get(s, "https://a.com/")
+	if data, err := ioutil.ReadFile(path); err != nil || strings.Count(string(data), "\n") != 1 {
+		t.Errorf("expected a new file after reopening, got %q %v", data, err)
+	}
+}
+
+func TestErrorPages(t *testing.T) {
+	dir, err := ioutil.TempDir("", "slashing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for name, content := range map[string]string{"404.html": "<h1>lost</h1>", "50x.html": "<h1>broken</h1>", "down.html": "<h1>back soon</h1>"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	app := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("X-App", "1")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("stack trace"))
+	}))
+	defer app.Close()
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	s := newTestServer(t, `
+domain=static.com:`+dir+`
+error_page=404 `+filepath.Join(dir, "404.html")+`
+domain=app.com
+backend=`+hostOf(app)+`
+error_page=500 502 `+filepath.Join(dir, "50x.html")+`
+intercept_errors=on
+domain=plain.com
+backend=`+hostOf(app)+`
+error_page=500 `+filepath.Join(dir, "50x.html")+`
+domain=down.com
+backend=`+hostOf(down)+`
+error_page=502 `+filepath.Join(dir, "50x.html")+`
+domain=maintenance.com
+maintenance_page=`+filepath.Join(dir, "down.html")+` retry_after=2m
+`)
+	defer s.Shutdown(context.Background())
+
+	for _, c := range []struct {
+		url    string
+		status int
+		body   string
+	}{
+		{"https://static.com/missing.png", http.StatusNotFound, "<h1>lost</h1>"},
+		{"https://static.com/404.html", http.StatusOK, "<h1>lost</h1>"},
+		{"https://app.com/", http.StatusInternalServerError, "<h1>broken</h1>"},
+		{"https://plain.com/", http.StatusInternalServerError, "stack trace"},
+		{"https://down.com/", http.StatusBadGateway, "<h1>broken</h1>"},
+		{"https://maintenance.com/", http.StatusServiceUnavailable, "<h1>back soon</h1>"},
+		{"https://unknown.com/", http.StatusNotFound, "Unknown host\n"},
+	} {
+		if status, body := get(s, c.url); status != c.status || body != c.body {
+			t.Errorf("%s: expected %d %q, got %d %q", c.url, c.status, c.body, status, body)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "https://app.com/", nil))
+	if w.Header().Get("Content-Type") != "text/html; charset=utf-8" || w.Header().Get("X-App") != "1" || w.Header().Get("Cache-Control") != "no-store" {
+		t.Errorf("unexpected headers of an intercepted error %v", w.Header())
+	}
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "https://maintenance.com/", nil))
+	if w.Header().Get("Retry-After") != "120" {
+		t.Errorf("expected the maintenance page to ask for a retry in 120s, got %v", w.Header())
+	}
+}
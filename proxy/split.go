@@ -0,0 +1,104 @@
+package proxy
+
+import (
+	"hash/crc32"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync/atomic"
+
+	"slashing/config"
+)
+
+// split sends a share of the clients of a route to a canary pool. The share
+// can be changed at runtime through the admin API.
+type split struct {
+	route       string
+	pool        *Pool
+	rules       *config.Split
+	basisPoints int64 //the share in hundredths of a percent, atomic
+}
+
+func newSplit(rt *route, pool *Pool, rules *config.Split) *split {
+	sp := &split{route: rt.name, pool: pool, rules: rules}
+	sp.setPercent(rules.Percent)
+	return sp
+}
+
+func (sp *split) setPercent(percent float64) {
+	atomic.StoreInt64(&sp.basisPoints, int64(math.Round(percent*100)))
+}
+
+func (sp *split) percent() float64 {
+	return float64(atomic.LoadInt64(&sp.basisPoints)) / 100
+}
+
+// canary reports whether r goes to the canary pool. A client is hashed by
+// IP, so it stays on the same side, and raising the share only moves more
+// clients over.
+func (sp *split) canary(r *http.Request) bool {
+	force := ""
+	if sp.rules.Header != "" {
+		force = r.Header.Get(sp.rules.Header)
+	}
+	if cookie, err := r.Cookie(sp.rules.Cookie); force == "" && sp.rules.Cookie != "" && err == nil {
+		force = cookie.Value
+	}
+	switch force {
+	case "always":
+		return true
+	case "never":
+		return false
+	}
+	return int64(crc32.ChecksumIEEE([]byte(clientIP(r)))%10000) < atomic.LoadInt64(&sp.basisPoints)
+}
+
+// poolFor returns the pool that serves r on rt.
+func (rt *route) poolFor(r *http.Request) *Pool {
+	if rt.split != nil && rt.split.canary(r) {
+		return rt.split.pool
+	}
+	return rt.pool
+}
+
+type splitStatus struct {
+	Route   string  `json:"route"`
+	Pool    string  `json:"pool"`
+	Percent float64 `json:"percent"`
+}
+
+// handleSplits lists the canary splits, or changes the share of the routes
+// splitting to a pool:
+//
+//	GET  /splits
+//	POST /splits?pool=canary&percent=25[&route=example.com/api/]
+func (s *Server) handleSplits(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		percent, err := strconv.ParseFloat(r.FormValue("percent"), 64)
+		if err != nil || percent < 0 || percent > 100 {
+			http.Error(w, "percent must be between 0 and 100", http.StatusBadRequest)
+			return
+		}
+		changed := 0
+		for _, sp := range s.splits {
+			if sp.pool.Name == r.FormValue("pool") && (r.FormValue("route") == "" || r.FormValue("route") == sp.route) {
+				sp.setPercent(percent)
+				changed++
+			}
+		}
+		if changed == 0 {
+			http.Error(w, "No route splits to this pool", http.StatusNotFound)
+			return
+		}
+	} else if r.Method != http.MethodGet {
+		http.Error(w, "GET or POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	statuses := []splitStatus{}
+	for _, sp := range s.splits {
+		statuses = append(statuses, splitStatus{Route: sp.route, Pool: sp.pool.Name, Percent: sp.percent()})
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Route < statuses[j].Route })
+	writeJSON(w, statuses)
+}
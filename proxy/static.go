@@ -0,0 +1,109 @@
+package proxy
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"slashing/utils"
+)
+
+type precompressedVariant struct {
+	encoding  string
+	extension string
+}
+
+// precompressed are the sibling files a static file may have, like nginx's
+// gzip_static, in order of preference.
+var precompressed = []precompressedVariant{
+	{"br", ".br"},
+	{"gzip", ".gz"},
+}
+
+// serveFile serves the file under root named by urlPath, if there is one.
+// A precompressed sibling (app.js.br, app.js.gz) is served instead when the
+// client accepts its encoding.
+func serveFile(w http.ResponseWriter, r *http.Request, root string, urlPath string) bool {
+	possibleStaticFile := filepath.Join(root, filepath.FromSlash(path.Clean("/"+urlPath)))
+	if !utils.FileExists(possibleStaticFile) {
+		return false
+	}
+	info, err := os.Stat(possibleStaticFile)
+	if err != nil {
+		return false
+	}
+	header := w.Header()
+	etag := fmt.Sprintf(`"%x-%x`, info.ModTime().UnixNano(), info.Size())
+
+	var variants []int //indexes in precompressed of the siblings that exist
+	for i, p := range precompressed {
+		if sibling, err := os.Stat(possibleStaticFile + p.extension); err == nil && sibling.Mode().IsRegular() && !sibling.ModTime().Before(info.ModTime()) {
+			variants = append(variants, i)
+		}
+	}
+	if len(variants) > 0 {
+		addVary(header, "Accept-Encoding")
+	}
+	if p, ok := pickPrecompressed(r.Header.Get("Accept-Encoding"), variants); ok {
+		file, err := os.Open(possibleStaticFile + p.extension)
+		if err == nil {
+			defer file.Close()
+			contentType := mime.TypeByExtension(filepath.Ext(possibleStaticFile))
+			if contentType == "" {
+				contentType = "application/octet-stream"
+			}
+			header.Set("Content-Type", contentType)
+			header.Set("Content-Encoding", p.encoding)
+			header.Set("ETag", etag+"-"+p.encoding+`"`)
+			http.ServeContent(w, r, possibleStaticFile, info.ModTime(), file)
+			return true
+		}
+	}
+	header.Set("ETag", etag+`"`)
+	http.ServeFile(w, r, possibleStaticFile)
+	return true
+}
+
+// pickPrecompressed picks the sibling whose encoding the client prefers.
+func pickPrecompressed(acceptEncoding string, variants []int) (precompressedVariant, bool) {
+	best, bestQ := -1, 0.0
+	for _, i := range variants {
+		if q := acceptQuality(acceptEncoding, precompressed[i].encoding); q > bestQ {
+			best, bestQ = i, q
+		}
+	}
+	if best < 0 {
+		return precompressedVariant{}, false
+	}
+	return precompressed[best], true
+}
+
+// acceptQuality returns the q-value the client gives an encoding in its
+// Accept-Encoding header, 0 if it does not accept it.
+func acceptQuality(acceptEncoding string, encoding string) float64 {
+	wildcard := 0.0
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		fields := strings.Split(strings.TrimSpace(part), ";")
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		switch name := strings.ToLower(strings.TrimSpace(fields[0])); name {
+		case encoding:
+			return q
+		case "*":
+			wildcard = q
+		}
+	}
+	return wildcard
+}
@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"log"
+	"net/http"
+
+	"slashing/config"
+)
+
+// sticky pins a client to the backend named in an affinity cookie. The
+// cookie holds an HMAC-SHA256 of the backend address, which the client can
+// neither read nor forge, and the pool finds the backend whose address
+// gives the same.
+type sticky struct {
+	config *config.Sticky
+	secret []byte
+}
+
+func newSticky(cfg *config.Sticky) *sticky {
+	if cfg == nil {
+		return nil
+	}
+	secret := []byte(cfg.Secret)
+	if len(secret) == 0 {
+		secret = make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Sticky cookie %s has no secret, affinity will not survive a restart", cfg.Cookie)
+	}
+	return &sticky{config: cfg, secret: secret}
+}
+
+// id is the cookie value of a backend address.
+func (s *sticky) id(address string) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(address))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// value returns the affinity cookie on r.
+func (s *sticky) value(r *http.Request) (string, bool) {
+	cookie, err := r.Cookie(s.config.Cookie)
+	if err != nil {
+		return "", false
+	}
+	return cookie.Value, true
+}
+
+func (s *sticky) cookie(backend *Backend) *http.Cookie {
+	return &http.Cookie{
+		Name:     s.config.Cookie,
+		Value:    s.id(backend.Address),
+		Path:     "/",
+		MaxAge:   int(s.config.MaxAge.Seconds()),
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// pinned returns the backend r is pinned to, if it can take the request.
+func (p *Pool) pinned(r *http.Request) *Backend {
+	value, ok := p.sticky.value(r)
+	if !ok {
+		return nil
+	}
+	for _, backend := range p.Backends {
+		if hmac.Equal([]byte(value), []byte(p.sticky.id(backend.Address))) && usable(backend) && backend.breaker.allow() {
+			return backend
+		}
+	}
+	return nil
+}
+
+// stick sets the affinity cookie on resp unless the client already carries
+// the one of the backend that answered.
+func (p *Pool) stick(resp *http.Response, backend *Backend) {
+	if p.sticky == nil {
+		return
+	}
+	if value, ok := p.sticky.value(resp.Request); ok && hmac.Equal([]byte(value), []byte(p.sticky.id(backend.Address))) {
+		return
+	}
+	resp.Header.Add("Set-Cookie", p.sticky.cookie(backend).String())
+}
@@ -0,0 +1,446 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"slashing/config"
+	"slashing/proxyproto"
+)
+
+// helloTimeout bounds the wait for the ClientHello of a TLS connection.
+const helloTimeout = 10 * time.Second
+
+// errHelloRead stops a handshake once the ClientHello has been read.
+var errHelloRead = errors.New("client hello read")
+
+// Stream forwards the raw TCP connections or UDP datagrams of a listener to
+// the pools of its routes.
+type Stream struct {
+	*config.Stream
+	routes   []*streamRoute //with an SNI, exact names before wildcards
+	fallback *streamRoute   //takes what no SNI route does, may be nil
+}
+
+type streamRoute struct {
+	sni  string
+	pool *Pool
+	tls  *tls.Config //terminates TLS, nil to pass it through
+}
+
+func (s *Server) newStream(cfg *config.Stream) (*Stream, error) {
+	st := &Stream{Stream: cfg}
+	for _, route := range cfg.Routes {
+		rt := &streamRoute{sni: route.SNI, pool: s.pools[route.Upstream]}
+		if route.Cert != "" {
+			cert, err := tls.LoadX509KeyPair(route.Cert, route.Key)
+			if err != nil {
+				return nil, fmt.Errorf("stream %s %s: %v", cfg.Protocol, cfg.Address, err)
+			}
+			rt.tls = &tls.Config{Certificates: []tls.Certificate{cert}}
+		}
+		if rt.sni == "" {
+			st.fallback = rt
+		} else {
+			st.routes = append(st.routes, rt)
+		}
+	}
+	sort.SliceStable(st.routes, func(i, j int) bool {
+		return !strings.HasPrefix(st.routes[i].sni, "*.") && strings.HasPrefix(st.routes[j].sni, "*.")
+	})
+	return st, nil
+}
+
+// Streams returns the TCP and UDP listeners to open.
+func (s *Server) Streams() []*Stream {
+	return s.streams
+}
+
+// route returns the SNI route of a server name, or nil.
+func (st *Stream) route(serverName string) *streamRoute {
+	for _, rt := range st.routes {
+		if rt.sni == serverName {
+			return rt
+		}
+		if !strings.HasPrefix(rt.sni, "*.") || !strings.HasSuffix(serverName, rt.sni[1:]) {
+			continue
+		}
+		//the wildcard stands for exactly one label, and not an empty one
+		if label := strings.TrimSuffix(serverName, rt.sni[1:]); label != "" && !strings.Contains(label, ".") {
+			return rt
+		}
+	}
+	return nil
+}
+
+// Serve forwards the connections accepted on ln until it fails.
+func (st *Stream) Serve(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			rt := st.fallback
+			if len(st.routes) > 0 {
+				var serverName string
+				serverName, conn = peekServerName(conn)
+				if sniRoute := st.route(serverName); sniRoute != nil {
+					rt = sniRoute
+				}
+			}
+			if rt != nil {
+				st.forward(conn, rt)
+			}
+		}()
+	}
+}
+
+// forward connects a client to a backend of its route and copies the bytes
+// both ways.
+func (st *Stream) forward(client net.Conn, rt *streamRoute) {
+	if rt.tls != nil {
+		tlsConn := tls.Server(client, rt.tls)
+		tlsConn.SetDeadline(time.Now().Add(helloTimeout))
+		if err := tlsConn.Handshake(); err != nil {
+			log.Printf("Stream %s: TLS handshake with %s failed: %v", st.Address, client.RemoteAddr(), err)
+			return
+		}
+		tlsConn.SetDeadline(time.Time{})
+		client = tlsConn
+	}
+	backend, conn := st.dial(client, rt.pool)
+	if conn == nil {
+		return
+	}
+	defer conn.Close()
+	defer atomic.AddInt64(&backend.active, -1)
+	pipe(client, conn, st.Timeout)
+}
+
+// dial connects to a backend of pool for client, trying the other backends
+// when one cannot be reached.
+func (st *Stream) dial(client net.Conn, pool *Pool) (*Backend, net.Conn) {
+	r := streamRequest(client.RemoteAddr())
+	tried := map[*Backend]bool{}
+	for backend := pool.Next(r); backend != nil; backend = pool.nextExcept(r, tried) {
+		tried[backend] = true
+		conn, err := dialBackend(backend.Address, 30*time.Second)
+		if err == nil && pool.sendProxyProtocol != 0 {
+			if err = proxyproto.WriteHeader(conn, pool.sendProxyProtocol, tcpAddrOf(client.RemoteAddr()), tcpAddrOf(client.LocalAddr())); err != nil {
+				conn.Close()
+			}
+		}
+		if err != nil {
+			backend.breaker.report(false)
+			log.Printf("Stream %s: cannot reach %s: %v", st.Address, backend.Address, err)
+			continue
+		}
+		backend.breaker.report(true)
+		atomic.AddInt64(&backend.active, 1)
+		return backend, conn
+	}
+	log.Printf("No backend for stream %s (pool %s)", st.Address, pool.Name)
+	return nil, nil
+}
+
+// streamRequest stands for a stream client in front of the balancers, which
+// pick backends for requests. A stream only has a client address.
+func streamRequest(client net.Addr) *http.Request {
+	return &http.Request{RemoteAddr: client.String(), Header: http.Header{}, URL: &url.URL{}}
+}
+
+// dialBackend connects to a host:port or unix:/path backend.
+func dialBackend(address string, timeout time.Duration) (net.Conn, error) {
+	if strings.HasPrefix(address, "unix:") {
+		return net.DialTimeout("unix", strings.TrimPrefix(address, "unix:"), timeout)
+	}
+	return net.DialTimeout("tcp", address, timeout)
+}
+
+func tcpAddrOf(addr net.Addr) *net.TCPAddr {
+	if tcp, ok := addr.(*net.TCPAddr); ok {
+		return tcp
+	}
+	return &net.TCPAddr{IP: net.IPv4zero}
+}
+
+// pipe copies between two connections both ways, until both directions
+// ended or neither carried anything for timeout.
+func pipe(a, b net.Conn, timeout time.Duration) {
+	last := time.Now().UnixNano()
+	done := make(chan struct{}, 2)
+	copyHalf := func(dst, src net.Conn) {
+		defer func() { done <- struct{}{} }()
+		buf := make([]byte, 32<<10)
+		for {
+			src.SetReadDeadline(time.Now().Add(timeout))
+			n, err := src.Read(buf)
+			if n > 0 {
+				atomic.StoreInt64(&last, time.Now().UnixNano())
+				dst.SetWriteDeadline(time.Now().Add(timeout))
+				if _, werr := dst.Write(buf[:n]); werr != nil {
+					a.Close()
+					b.Close()
+					return
+				}
+			}
+			if err == io.EOF {
+				if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+					cw.CloseWrite()
+				}
+				return
+			}
+			if err != nil {
+				if ne, ok := err.(net.Error); ok && ne.Timeout() && time.Since(time.Unix(0, atomic.LoadInt64(&last))) < timeout {
+					continue //the other direction is busy
+				}
+				a.Close()
+				b.Close()
+				return
+			}
+		}
+	}
+	go copyHalf(b, a)
+	copyHalf(a, b)
+	<-done
+	<-done
+}
+
+// peekServerName reads the ClientHello of a TLS connection and returns the
+// server name it asks for, with a connection that reads the ClientHello
+// again. The name is empty when the client sent something else.
+func peekServerName(conn net.Conn) (string, net.Conn) {
+	var hello bytes.Buffer
+	serverName := ""
+	conn.SetReadDeadline(time.Now().Add(helloTimeout))
+	tls.Server(readOnlyConn{Conn: conn, r: io.TeeReader(conn, &hello)}, &tls.Config{
+		GetConfigForClient: func(info *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = info.ServerName
+			return nil, errHelloRead
+		},
+	}).Handshake()
+	conn.SetReadDeadline(time.Time{})
+	return strings.ToLower(serverName), &peekedConn{Conn: conn, r: io.MultiReader(&hello, conn)}
+}
+
+// readOnlyConn lets a handshake read a connection without answering.
+type readOnlyConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c readOnlyConn) Read(b []byte) (int, error)  { return c.r.Read(b) }
+func (c readOnlyConn) Write(b []byte) (int, error) { return 0, io.ErrClosedPipe }
+
+// peekedConn reads what was peeked before the rest of the connection.
+type peekedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *peekedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *peekedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// ShareTLS lets the SNI routes of the stream on the HTTPS port take their
+// connections from ln, the listener of the HTTPS server, which gets all the
+// others.
+func (s *Server) ShareTLS(ln net.Listener) net.Listener {
+	for _, st := range s.streams {
+		if st.SharesHTTPS() && len(st.routes) > 0 {
+			l := &sniListener{Listener: ln, stream: st, conns: make(chan net.Conn), errs: make(chan error), done: make(chan struct{})}
+			go l.run()
+			return l
+		}
+	}
+	return ln
+}
+
+// sniListener sorts the connections of a listener by their ClientHello.
+// Sorting happens off the accept loop, so that slow clients do not hold up
+// the others.
+type sniListener struct {
+	net.Listener
+	stream *Stream
+	conns  chan net.Conn //for the HTTPS server
+	errs   chan error
+	done   chan struct{}
+	once   sync.Once
+}
+
+func (l *sniListener) run() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			select {
+			case l.errs <- err:
+			case <-l.done:
+				return
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return
+		}
+		go l.sort(conn)
+	}
+}
+
+func (l *sniListener) sort(conn net.Conn) {
+	serverName, conn := peekServerName(conn)
+	if rt := l.stream.route(serverName); rt != nil {
+		defer conn.Close()
+		l.stream.forward(conn, rt)
+		return
+	}
+	select {
+	case l.conns <- conn:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+func (l *sniListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case err := <-l.errs:
+		return nil, err
+	case <-l.done:
+		return nil, errListenerClosed
+	}
+}
+
+var errListenerClosed = errors.New("listener closed")
+
+func (l *sniListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return l.Listener.Close()
+}
+
+// ServePacket forwards the datagrams received on pc until it fails. Each
+// client address gets a session with one backend, which ends after the
+// stream timeout without traffic.
+func (st *Stream) ServePacket(pc net.PacketConn) error {
+	var mu sync.Mutex
+	sessions := map[string]*udpSession{}
+	buf := make([]byte, 64<<10)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		key := addr.String()
+		mu.Lock()
+		session := sessions[key]
+		if session == nil {
+			session = st.newUDPSession(addr, st.fallback.pool)
+			if session != nil {
+				sessions[key] = session
+				go session.reply(pc, st.Timeout, func(idle bool) bool {
+					mu.Lock()
+					defer mu.Unlock()
+					if idle && time.Since(time.Unix(0, atomic.LoadInt64(&session.last))) < st.Timeout {
+						return false //a datagram came in meanwhile
+					}
+					delete(sessions, key)
+					session.conn.Close()
+					return true
+				})
+			}
+		}
+		//under the lock, so that the session cannot close in between
+		if session != nil {
+			atomic.StoreInt64(&session.last, time.Now().UnixNano())
+			session.conn.Write(buf[:n])
+		}
+		mu.Unlock()
+	}
+}
+
+// udpSession is the exchange of one client with its backend.
+type udpSession struct {
+	client  net.Addr
+	backend *Backend
+	conn    net.Conn
+	last    int64 //of the last datagram either way, read atomically
+}
+
+func (st *Stream) newUDPSession(client net.Addr, pool *Pool) *udpSession {
+	backend := pool.Next(streamRequest(client))
+	if backend == nil {
+		log.Printf("No backend for stream %s (pool %s)", st.Address, pool.Name)
+		return nil
+	}
+	conn, err := net.Dial("udp", backend.Address)
+	if err != nil {
+		backend.breaker.report(false)
+		log.Printf("Stream %s: cannot reach %s: %v", st.Address, backend.Address, err)
+		return nil
+	}
+	atomic.AddInt64(&backend.active, 1)
+	return &udpSession{client: client, backend: backend, conn: conn, last: time.Now().UnixNano()}
+}
+
+// reply sends the answers of the backend to the client until the session
+// is idle for timeout. end removes and closes the session, unless it was
+// idle and a datagram came in since. The first answer, or an error such as
+// a refused port, tells the circuit breaker how the backend is doing.
+func (u *udpSession) reply(pc net.PacketConn, timeout time.Duration, end func(idle bool) bool) {
+	defer atomic.AddInt64(&u.backend.active, -1)
+	replied := false
+	buf := make([]byte, 64<<10)
+	for {
+		u.conn.SetReadDeadline(time.Now().Add(timeout))
+		n, err := u.conn.Read(buf)
+		if err != nil {
+			ne, ok := err.(net.Error)
+			timedOut := ok && ne.Timeout()
+			if timedOut && time.Since(time.Unix(0, atomic.LoadInt64(&u.last))) < timeout {
+				continue
+			}
+			if !end(timedOut) {
+				continue
+			}
+			if !replied {
+				if timedOut {
+					u.backend.breaker.release()
+				} else {
+					u.backend.breaker.report(false)
+				}
+			}
+			return
+		}
+		if !replied {
+			replied = true
+			u.backend.breaker.report(true)
+		}
+		atomic.StoreInt64(&u.last, time.Now().UnixNano())
+		pc.WriteTo(buf[:n], u.client)
+	}
+}
@@ -0,0 +1,140 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http2"
+
+	"slashing/config"
+	"slashing/proxyproto"
+)
+
+// poolTransport sends each proxied request through the transport of the
+// pool that was picked for it.
+type poolTransport struct{}
+
+func (poolTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	pool := exchangeOf(req).pool
+	if pool.retry != nil {
+		return roundTripWithRetries(req)
+	}
+	return pool.transport.RoundTrip(req)
+}
+
+func newTransport(upstream *config.Upstream) (http.RoundTripper, error) {
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	sockets := map[string]string{}
+	for i, b := range upstream.Backends {
+		if strings.HasPrefix(b.Address, "unix:") {
+			sockets[socketHost(i)] = strings.TrimPrefix(b.Address, "unix:")
+		}
+	}
+	dial := func(ctx context.Context, network, address string) (net.Conn, error) {
+		if host, _, err := net.SplitHostPort(address); err == nil && sockets[host] != "" {
+			network, address = "unix", sockets[host]
+		}
+		return dialer.DialContext(ctx, network, address)
+	}
+	if len(upstream.Backends) > 0 && upstream.Backends[0].Scheme == "h2c" {
+		//HTTP/2 without TLS, what gRPC services speak in cleartext
+		return &http2.Transport{
+			AllowHTTP: true,
+			DialTLS: func(network, address string, _ *tls.Config) (net.Conn, error) {
+				return dial(context.Background(), network, address)
+			},
+		}, nil
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dial
+	if version := upstream.SendProxyProtocol; version != 0 {
+		//the header names one client, so connections cannot be shared
+		transport.DisableKeepAlives = true
+		transport.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+			conn, err := dial(ctx, network, address)
+			if err != nil {
+				return nil, err
+			}
+			if err := proxyproto.WriteHeader(conn, version, clientAddr(ctx), serverAddr(ctx)); err != nil {
+				conn.Close()
+				return nil, err
+			}
+			return conn, nil
+		}
+	}
+	if upstream.TLS != nil {
+		tlsConfig, err := upstreamTLSConfig(upstream.TLS)
+		if err != nil {
+			return nil, fmt.Errorf("upstream %s: %v", upstream.Name, err)
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+	return transport, nil
+}
+
+// socketHost stands for the unix socket of the i-th backend of a pool in
+// the URLs sent to it, since a URL host cannot hold a path. The transport
+// of the pool dials the socket instead.
+func socketHost(i int) string {
+	return "unix-socket-" + strconv.Itoa(i)
+}
+
+// upstreamTLSConfig builds the client side TLS configuration of a pool.
+func upstreamTLSConfig(t *config.UpstreamTLS) (*tls.Config, error) {
+	tlsConfig := &tls.Config{ServerName: t.ServerName, InsecureSkipVerify: t.InsecureSkipVerify}
+	if t.CA != "" {
+		pem, err := ioutil.ReadFile(t.CA)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", t.CA)
+		}
+	}
+	if t.Cert != "" {
+		cert, err := tls.LoadX509KeyPair(t.Cert, t.Key)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// clientAddr is the client of the request being dialed for.
+func clientAddr(ctx context.Context) *net.TCPAddr {
+	if ex, ok := ctx.Value(exchangeKey).(*exchange); ok && ex.client != nil {
+		return ex.client
+	}
+	return &net.TCPAddr{IP: net.IPv4zero}
+}
+
+// serverAddr is the local address the client connected to.
+func serverAddr(ctx context.Context) *net.TCPAddr {
+	if addr, ok := ctx.Value(http.LocalAddrContextKey).(*net.TCPAddr); ok {
+		return addr
+	}
+	return &net.TCPAddr{IP: net.IPv4zero}
+}
+
+// clientTCPAddr is the real client address of r, with the peer's port when
+// the client is the peer itself.
+func clientTCPAddr(r *http.Request) *net.TCPAddr {
+	addr := &net.TCPAddr{IP: net.ParseIP(clientIP(r))}
+	if addr.IP == nil {
+		return nil
+	}
+	if peer, err := net.ResolveTCPAddr("tcp", r.RemoteAddr); err == nil && peer.IP.Equal(addr.IP) {
+		addr.Port = peer.Port
+	}
+	return addr
+}
@@ -0,0 +1,345 @@
+// Package proxyproto reads and writes HAProxy PROXY protocol headers, which
+// L4 load balancers put in front of a connection to pass on the client's
+// address.
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// signature starts every version 2 header.
+var signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+const (
+	v1Prefix    = "PROXY "
+	v1MaxLength = 107 //from the spec, including the CRLF
+)
+
+// ErrInvalidHeader is returned by Conn when a trusted peer sends a malformed header.
+var ErrInvalidHeader = errors.New("proxyproto: invalid PROXY protocol header")
+
+// ErrNoHeader is returned by Conn when a trusted peer sends no header at all.
+var ErrNoHeader = errors.New("proxyproto: no PROXY protocol header")
+
+// Listener accepts connections and reads the PROXY header of those coming
+// from a trusted network. Connections from other peers are served as they
+// are, so a client cannot fake its address. A trusted peer must send a
+// header: its connections are closed otherwise, since they would pass for
+// the balancer's own.
+type Listener struct {
+	net.Listener
+	Trusted []*net.IPNet
+	Timeout time.Duration //time a trusted peer has to send its header, 0 for 5s
+
+	start    sync.Once
+	accepted chan accepted
+	closed   chan struct{} //closed when the underlying listener fails for good
+	err      error         //why it failed
+}
+
+type accepted struct {
+	conn net.Conn
+	err  error
+}
+
+// Accept waits for the next connection. The header of a trusted peer is
+// read in a goroutine of its own, so that a peer slow to send it does not
+// hold up the others, and its connection is only returned once the header
+// is in. Trusted peers without a valid header are dropped.
+func (l *Listener) Accept() (net.Conn, error) {
+	l.start.Do(l.init)
+	select {
+	case a := <-l.accepted:
+		return a.conn, a.err
+	case <-l.closed:
+		return nil, l.err
+	}
+}
+
+func (l *Listener) init() {
+	l.accepted, l.closed = make(chan accepted), make(chan struct{})
+	go l.acceptLoop()
+}
+
+func (l *Listener) acceptLoop() {
+	timeout := l.Timeout
+	if timeout == 0 {
+		timeout = 5 * time.Second
+	}
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				l.hand(accepted{err: err})
+				continue
+			}
+			l.err = err
+			close(l.closed)
+			return
+		}
+		if !l.trusted(conn.RemoteAddr()) {
+			l.hand(accepted{conn: conn})
+			continue
+		}
+		go func() {
+			c := &Conn{Conn: conn, reader: bufio.NewReader(conn), timeout: timeout}
+			c.once.Do(c.readHeader)
+			if c.err == nil {
+				l.hand(accepted{conn: c})
+			}
+		}()
+	}
+}
+
+// hand passes a connection on to Accept, or closes it when the listener
+// is closed.
+func (l *Listener) hand(a accepted) {
+	select {
+	case l.accepted <- a:
+	case <-l.closed:
+		if a.conn != nil {
+			a.conn.Close()
+		}
+	}
+}
+
+func (l *Listener) trusted(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, network := range l.Trusted {
+		if network.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// Conn is a connection from a trusted peer. Its RemoteAddr and LocalAddr are
+// the ones of the PROXY header, unless the header carries no addresses.
+type Conn struct {
+	net.Conn
+	reader  *bufio.Reader
+	timeout time.Duration
+
+	once   sync.Once
+	err    error
+	remote net.Addr
+	local  net.Addr
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+// RemoteAddr returns the client address of the header, or the peer's address.
+func (c *Conn) RemoteAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// LocalAddr returns the destination address of the header, or the local one.
+func (c *Conn) LocalAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.local != nil {
+		return c.local
+	}
+	return c.Conn.LocalAddr()
+}
+
+func (c *Conn) readHeader() {
+	c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+	defer c.Conn.SetReadDeadline(time.Time{})
+
+	version, err := headerVersion(c.reader)
+	switch {
+	case err == io.EOF:
+		//closed before sending anything, as TCP health checks do
+	case err != nil:
+		c.err = err
+	case version == 0:
+		log.Printf("Closing the connection of %s: no PROXY protocol header from a trusted network", c.Conn.RemoteAddr())
+		c.err = ErrNoHeader
+	default:
+		c.remote, c.local, c.err = ReadHeader(c.reader)
+	}
+	if c.err != nil {
+		c.Conn.Close()
+	}
+}
+
+// headerVersion returns the version of the header r starts with, or 0 when
+// r does not start with one. It consumes nothing.
+func headerVersion(r *bufio.Reader) (int, error) {
+	start, err := r.Peek(1)
+	if err != nil {
+		return 0, err
+	}
+	switch start[0] {
+	case signature[0]:
+		if prefix, err := r.Peek(len(signature)); err == nil && bytes.Equal(prefix, signature) {
+			return 2, nil
+		}
+	case v1Prefix[0]:
+		if prefix, err := r.Peek(len(v1Prefix)); err == nil && string(prefix) == v1Prefix {
+			return 1, nil
+		}
+	}
+	return 0, nil
+}
+
+// ReadHeader consumes a version 1 or 2 header from r. It returns nil
+// addresses, and consumes nothing, when r does not start with a header. A
+// header without addresses (LOCAL or UNKNOWN) also returns nil addresses.
+func ReadHeader(r *bufio.Reader) (source net.Addr, destination net.Addr, err error) {
+	version, err := headerVersion(r)
+	switch {
+	case err == io.EOF:
+		return nil, nil, nil
+	case err != nil:
+		return nil, nil, err
+	case version == 2:
+		return readV2(r)
+	case version == 1:
+		return readV1(r)
+	}
+	return nil, nil, nil
+}
+
+func readV1(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	line := make([]byte, 0, v1MaxLength)
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+		if len(line) == v1MaxLength {
+			return nil, nil, ErrInvalidHeader
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, ErrInvalidHeader
+	}
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, ErrInvalidHeader
+	}
+	source, err := tcpAddr(fields[2], fields[4])
+	if err != nil {
+		return nil, nil, err
+	}
+	destination, err := tcpAddr(fields[3], fields[5])
+	if err != nil {
+		return nil, nil, err
+	}
+	return source, destination, nil
+}
+
+func tcpAddr(ip, port string) (*net.TCPAddr, error) {
+	addr := &net.TCPAddr{IP: net.ParseIP(ip)}
+	n, err := strconv.ParseUint(port, 10, 16)
+	if addr.IP == nil || err != nil {
+		return nil, ErrInvalidHeader
+	}
+	addr.Port = int(n)
+	return addr, nil
+}
+
+func readV2(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, nil, err
+	}
+	if header[12]>>4 != 2 {
+		return nil, nil, ErrInvalidHeader
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, nil, err
+	}
+	command, family := header[12]&0x0f, header[13]
+	if command == 0x0 {
+		//LOCAL: a health check of the balancer itself
+		return nil, nil, nil
+	}
+	if command != 0x1 {
+		return nil, nil, ErrInvalidHeader
+	}
+	var size int
+	switch family >> 4 {
+	case 0x1:
+		size = net.IPv4len
+	case 0x2:
+		size = net.IPv6len
+	default:
+		//AF_UNSPEC and AF_UNIX carry no address we can use
+		return nil, nil, nil
+	}
+	if len(payload) < 2*size+4 {
+		return nil, nil, ErrInvalidHeader
+	}
+	source, destination := net.IP(payload[:size]), net.IP(payload[size:2*size])
+	ports := payload[2*size:]
+	sourcePort, destinationPort := int(binary.BigEndian.Uint16(ports)), int(binary.BigEndian.Uint16(ports[2:]))
+	if family&0x0f == 0x2 {
+		return &net.UDPAddr{IP: source, Port: sourcePort}, &net.UDPAddr{IP: destination, Port: destinationPort}, nil
+	}
+	return &net.TCPAddr{IP: source, Port: sourcePort}, &net.TCPAddr{IP: destination, Port: destinationPort}, nil
+}
+
+// WriteHeader writes a header of the given version (1 or 2) announcing a
+// TCP connection from source to destination.
+func WriteHeader(w io.Writer, version int, source, destination *net.TCPAddr) error {
+	ipv4 := source.IP.To4() != nil && destination.IP.To4() != nil
+	switch version {
+	case 1:
+		family := "TCP6"
+		if ipv4 {
+			family = "TCP4"
+		}
+		_, err := fmt.Fprintf(w, "PROXY %s %s %s %d %d\r\n", family, source.IP, destination.IP, source.Port, destination.Port)
+		return err
+	case 2:
+		header := append([]byte{}, signature...)
+		srcIP, dstIP, family := source.IP.To16(), destination.IP.To16(), byte(0x21)
+		if ipv4 {
+			srcIP, dstIP, family = source.IP.To4(), destination.IP.To4(), 0x11
+		}
+		header = append(header, 0x21, family, 0, 0)
+		binary.BigEndian.PutUint16(header[14:], uint16(2*len(srcIP)+4))
+		header = append(header, srcIP...)
+		header = append(header, dstIP...)
+		ports := make([]byte, 4)
+		binary.BigEndian.PutUint16(ports, uint16(source.Port))
+		binary.BigEndian.PutUint16(ports[2:], uint16(destination.Port))
+		_, err := w.Write(append(header, ports...))
+		return err
+	}
+	return fmt.Errorf("proxyproto: unknown version %d", version)
+}
@@ -0,0 +1,195 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRoundTrip(t *testing.T) {
+	for _, version := range []int{1, 2} {
+		for _, ips := range [][2]string{{"203.0.113.9", "10.0.0.1"}, {"2001:db8::1", "2001:db8::2"}} {
+			source := &net.TCPAddr{IP: net.ParseIP(ips[0]), Port: 51234}
+			destination := &net.TCPAddr{IP: net.ParseIP(ips[1]), Port: 443}
+			buf := &bytes.Buffer{}
+			if err := WriteHeader(buf, version, source, destination); err != nil {
+				t.Fatal(err)
+			}
+			buf.WriteString("GET / HTTP/1.1\r\n")
+
+			r := bufio.NewReader(buf)
+			src, dst, err := ReadHeader(r)
+			if err != nil {
+				t.Fatalf("v%d %s: %v", version, ips[0], err)
+			}
+			if src.String() != source.String() || dst.String() != destination.String() {
+				t.Errorf("v%d: got %s -> %s, want %s -> %s", version, src, dst, source, destination)
+			}
+			if rest, _ := ioutil.ReadAll(r); string(rest) != "GET / HTTP/1.1\r\n" {
+				t.Errorf("v%d: header not fully consumed, rest is %q", version, rest)
+			}
+		}
+	}
+}
+
+func TestReadHeaderWithoutHeader(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("PING\r\n"))
+	src, _, err := ReadHeader(r)
+	if src != nil || err != nil {
+		t.Fatal("a plain connection should not have a header")
+	}
+	if rest, _ := ioutil.ReadAll(r); string(rest) != "PING\r\n" {
+		t.Fatal("plain data was consumed:", string(rest))
+	}
+}
+
+func TestReadHeaderInvalid(t *testing.T) {
+	for _, input := range []string{
+		"PROXY TCP4 1.2.3.4\r\n",
+		"PROXY TCP4 1.2.3.4 5.6.7.8 99999 80\r\n",
+		"PROXY TCP4 1.2.3.4 5.6.7.8 1 80" + strings.Repeat(" ", 100) + "\r\n",
+	} {
+		if _, _, err := ReadHeader(bufio.NewReader(strings.NewReader(input))); err == nil {
+			t.Errorf("expected an error for %q", input)
+		}
+	}
+}
+
+func TestListenerTrust(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	pl := &Listener{Listener: ln, Trusted: []*net.IPNet{loopback}}
+	defer pl.Close()
+
+	go func() {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			return
+		}
+		conn.Write([]byte("PROXY TCP4 198.51.100.7 127.0.0.1 4000 80\r\nhello"))
+		conn.Close()
+	}()
+	conn, err := pl.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := conn.RemoteAddr().String(); got != "198.51.100.7:4000" {
+		t.Fatal("remote address should come from the header, got", got)
+	}
+	if data, _ := ioutil.ReadAll(conn); string(data) != "hello" {
+		t.Fatal("unexpected payload", string(data))
+	}
+}
+
+// acceptAll accepts the connections of l until it is closed.
+func acceptAll(l net.Listener) <-chan net.Conn {
+	conns := make(chan net.Conn, 10)
+	go func() {
+		defer close(conns)
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conns <- conn
+		}
+	}()
+	return conns
+}
+
+// dial connects to l and sends data.
+func dial(t *testing.T, l net.Listener, data string) net.Conn {
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte(data))
+	return conn
+}
+
+func TestListenerWithoutHeader(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	pl := &Listener{Listener: ln, Trusted: []*net.IPNet{loopback}}
+	defer pl.Close()
+	conns := acceptAll(pl)
+
+	plain := dial(t, pl, "hello")
+	defer plain.Close()
+	plain.(*net.TCPConn).CloseWrite()
+	if data, err := ioutil.ReadAll(plain); len(data) > 0 || isTimeout(err) {
+		t.Fatalf("a trusted peer without a header should be dropped, got %q, %v", data, err)
+	}
+	proxied := dial(t, pl, "PROXY TCP4 198.51.100.7 127.0.0.1 4000 80\r\n")
+	defer proxied.Close()
+	select {
+	case conn := <-conns:
+		if got := conn.RemoteAddr().String(); got != "198.51.100.7:4000" {
+			t.Fatal("only the connection with a header should be accepted, got one from", got)
+		}
+		conn.Close()
+	case <-time.After(2 * time.Second):
+		t.Fatal("the connection with a header was not accepted")
+	}
+
+	//untrusted peers are served as they are
+	ln, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, private, _ := net.ParseCIDR("10.0.0.0/8")
+	pl = &Listener{Listener: ln, Trusted: []*net.IPNet{private}}
+	defer pl.Close()
+	conns = acceptAll(pl)
+	untrusted := dial(t, pl, "hello")
+	defer untrusted.Close()
+	untrusted.(*net.TCPConn).CloseWrite()
+	conn := <-conns
+	if data, err := ioutil.ReadAll(conn); err != nil || string(data) != "hello" {
+		t.Errorf("an untrusted peer should be served as it is, got %q, %v", data, err)
+	}
+	conn.Close()
+}
+
+func TestListenerSlowHeader(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	pl := &Listener{Listener: ln, Trusted: []*net.IPNet{loopback}, Timeout: time.Hour}
+	defer pl.Close()
+	conns := acceptAll(pl)
+
+	//a peer that sends nothing does not hold up the next one
+	silent := dial(t, pl, "")
+	defer silent.Close()
+	time.Sleep(10 * time.Millisecond)
+	proxied := dial(t, pl, "PROXY TCP4 198.51.100.7 127.0.0.1 4000 80\r\n")
+	defer proxied.Close()
+	select {
+	case conn := <-conns:
+		if got := conn.RemoteAddr().String(); got != "198.51.100.7:4000" {
+			t.Fatal("unexpected connection from", got)
+		}
+		conn.Close()
+	case <-time.After(2 * time.Second):
+		t.Fatal("a silent trusted peer held up the accept loop")
+	}
+}
+
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
@@ -321,6 +321,19 @@ func (e *Entry) value() interface{} {
 	return *(*interface{})(e.p)
 }
 
+func (m *HashMap) Keys() (keys []interface{}) {
+	m.RLock()
+	defer m.RUnlock()
+	for _, node := range m.nodes {
+		node.Lock()
+		for next := node.head; next != nil; next = next.next {
+			keys = append(keys, next.k)
+		}
+		node.Unlock()
+	}
+	return
+}
+
 func (m *HashMap) FromJSON(b []byte) error {
 	data := map[string]interface{}{}
 	err := json.Unmarshal(b, &data)
@@ -31,7 +31,15 @@ func (r *RedisServer) Shutdown(ctx context.Context) error {
 	return r.Close()
 }
 
-func NewRedisServer(addr string) RedisServer {
+// Items returns the key-value store behind the server, so that other parts
+// of slashing can share data with the Redis clients.
+func (r *RedisServer) Items() *hashmap.HashMap {
+	return r.items
+}
+
+// NewRedisServer creates the Redis-compatible server of addr on network, tcp
+// or unix.
+func NewRedisServer(network, addr string) RedisServer {
 	setItems := skiplist.New() //"Lockless" (TODO: Set)
 
 	var items *hashmap.HashMap //"Lockless"
@@ -48,7 +56,7 @@ func NewRedisServer(addr string) RedisServer {
 		utils.FilePutContents(data, path)
 	}
 
-	server := redcon.NewServerNetwork("tcp", addr,
+	server := redcon.NewServerNetwork(network, addr,
 		func(conn redcon.Conn, cmd redcon.Command) {
 			switch strings.ToLower(string(cmd.Args[0])) {
 			default:
@@ -69,7 +77,7 @@ func NewRedisServer(addr string) RedisServer {
 				ks := []interface{}{}
 				vs := []interface{}{}
 				for i := 1; i < len(cmd.Args)-1; i += 2 {
-					ks = append(ks, cmd.Args[i])
+					ks = append(ks, string(cmd.Args[i]))
 					vs = append(vs, cmd.Args[i+1])
 				}
 				items.MSet(ks, vs)
@@ -77,8 +85,12 @@ func NewRedisServer(addr string) RedisServer {
 			case "mget":
 				conn.WriteArray(len(cmd.Args) - 1)
 				for i := 1; i < len(cmd.Args); i++ {
-					data, _ := items.Get(cmd.Args[i])
-					conn.WriteBulk(data.([]byte))
+					data, ok := items.Get(string(cmd.Args[i]))
+					if !ok {
+						conn.WriteNull()
+					} else {
+						conn.WriteBulk(data.([]byte))
+					}
 				}
 			case "sadd":
 				if len(cmd.Args) != 3 {
@@ -101,7 +113,7 @@ func NewRedisServer(addr string) RedisServer {
 					conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
 					return
 				}
-				val, ok := items.Get(cmd.Args[1])
+				val, ok := items.Get(string(cmd.Args[1]))
 				if !ok {
 					conn.WriteNull()
 				} else {